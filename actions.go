@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/mkanoor/catalog_mqtt_client/internal/taskerror"
+)
+
+// jobAction is a job method that posts to an endpoint of the href_slug
+// and monitors the Tower job it starts
+type jobAction struct {
+	endpoint string // appended to the href_slug
+	expected []int  // the status codes accepted by default
+	idField  string // the attribute with the id of the started job
+	jobHref  string // the href of the started job built from the id
+	sameJob  bool   // monitor the href_slug instead of a new job
+}
+
+var jobActions = map[string]jobAction{
+	"relaunch":                {endpoint: "relaunch", expected: []int{201}},
+	"cancel":                  {endpoint: "cancel", expected: []int{202}, sameJob: true},
+	"update_inventory_source": {endpoint: "update", expected: []int{202}, idField: "inventory_update", jobHref: "/api/v2/inventory_updates/%d/"},
+	"update_project":          {endpoint: "update", expected: []int{202}, idField: "project_update", jobHref: "/api/v2/project_updates/%d/"},
+}
+
+// runAction posts to the endpoint of the action and monitors the job
+func (w *WorkUnit) runAction(action jobAction) error {
+	body, err := w.postAction(action.endpoint, action.expected)
+	if err != nil {
+		return err
+	}
+	href := w.input.HrefSlug
+	if !action.sameJob {
+		href, err = startedJob(body, action)
+		if err != nil {
+			w.sendError(taskerror.Data, err.Error())
+			w.glog.Errorf("Error %v", err)
+			return err
+		}
+	}
+	// Register the job right away so it can be canceled before the
+	// monitor starts
+	w.task.addTowerJob(href)
+	return w.monitorJob(href)
+}
+
+// postAction posts the params to an endpoint below the href_slug and
+// writes the response page, it returns the unfiltered response
+func (w *WorkUnit) postAction(endpoint string, expected []int) ([]byte, error) {
+	u, err := w.resolve(strings.TrimSuffix(w.parsedURL.Path, "/") + "/" + endpoint + "/")
+	if err != nil {
+		w.sendError(taskerror.Validation, err.Error())
+		w.glog.Errorf("Error %v", err)
+		return nil, err
+	}
+	b := []byte("{}")
+	if w.input.Params != nil {
+		b, err = json.Marshal(w.input.Params)
+		if err != nil {
+			w.glog.Errorf("Error %v", err)
+			return nil, err
+		}
+	}
+	resp, body, err := w.doRequest("POST", u, b, false)
+	if err != nil {
+		w.glog.Errorf("Error %v", err)
+		return nil, err
+	}
+	w.glog.Info("POST " + u.String() + " Status " + resp.Status)
+	if len(w.input.ExpectedStatus) > 0 {
+		expected = w.input.ExpectedStatus
+	}
+	if err := w.validateHTTPResponse("POST", resp, body, expected); err != nil {
+		return nil, err
+	}
+	if _, err := w.writeResponse(body, filepath.Join(w.parsedURL.Path, "response.json")); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// startedJob finds the href of the job started by the action in the
+// unfiltered response
+func startedJob(body []byte, action jobAction) (string, error) {
+	var job map[string]interface{}
+	if err := json.Unmarshal(body, &job); err != nil {
+		return "", err
+	}
+	if u, ok := job["url"].(string); ok && u != "" {
+		return u, nil
+	}
+	if id, ok := job[action.idField].(float64); ok && action.jobHref != "" {
+		return fmt.Sprintf(action.jobHref, int64(id)), nil
+	}
+	return "", fmt.Errorf("The response of %s doesn't have the started job", action.endpoint)
+}
+
+// monitorJob dispatches a monitor of the job with the monitor options of
+// the current job
+func (w *WorkUnit) monitorJob(href string) error {
+	return w.dispatchJob(JobParam{
+		Method:                 "monitor",
+		HrefSlug:               href,
+		ApplyFilter:            w.input.ApplyFilter,
+		RefreshIntervalSeconds: w.input.RefreshIntervalSeconds,
+		StreamOutput:           w.input.StreamOutput,
+		StreamMaxBytes:         w.input.StreamMaxBytes,
+		Redact:                 w.input.Redact,
+		MonitorMode:            w.input.MonitorMode,
+	})
+}
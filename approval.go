@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+)
+
+// PendingApproval is an approval node of a running workflow job that is
+// waiting for somebody to approve or deny it
+type PendingApproval struct {
+	ID         int64  `json:"id"`
+	NodeID     int64  `json:"node_id"`
+	Identifier string `json:"identifier,omitempty"`
+	Name       string `json:"name,omitempty"`
+	HrefSlug   string `json:"href_slug"`
+}
+
+// pendingApprovals collects the approval nodes of the workflow job that
+// are waiting for a decision
+func (w *WorkUnit) pendingApprovals(body []byte) ([]PendingApproval, error) {
+	approvals := []PendingApproval{}
+	err := w.eachWorkflowNode(body, func(n workflowNode) error {
+		job := n.SummaryFields.Job
+		if n.Job == nil || job.Type != "workflow_approval" || job.Status != "pending" {
+			return nil
+		}
+		href := n.Related.Job
+		if href == "" {
+			href = fmt.Sprintf("/api/v2/workflow_approvals/%d/", *n.Job)
+		}
+		approvals = append(approvals, PendingApproval{
+			ID:         *n.Job,
+			NodeID:     n.ID,
+			Identifier: n.Identifier,
+			Name:       job.Name,
+			HrefSlug:   href,
+		})
+		return nil
+	})
+	return approvals, err
+}
+
+// sameApprovals checks if the pending approvals didn't change since the
+// last report
+func sameApprovals(a, b []PendingApproval) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].ID != b[i].ID {
+			return false
+		}
+	}
+	return true
+}
+
+// decide approves or denies the workflow approval in the href_slug
+func (w *WorkUnit) decide(decision string) error {
+	_, err := w.postAction(decision, []int{200, 204})
+	return err
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// fakeBroker is a minimal stand-in for an MQTT Server, it supports
+// connect, subscribe, publish with QoS 0 and ping
+type fakeBroker struct {
+	t        *testing.T
+	listener net.Listener
+	mu       sync.Mutex
+	conns    map[net.Conn][]string
+	retained map[string][]byte
+	wills    map[string][]byte
+	subs     chan string
+	messages chan *packets.PublishPacket
+	connects int
+}
+
+func startFakeBroker(t *testing.T) *fakeBroker {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error starting broker %v", err)
+	}
+	b := &fakeBroker{t: t, listener: l,
+		conns:    make(map[net.Conn][]string),
+		retained: make(map[string][]byte),
+		wills:    make(map[string][]byte),
+		subs:     make(chan string, 10),
+		messages: make(chan *packets.PublishPacket, 100)}
+	go b.accept()
+	return b
+}
+
+func (b *fakeBroker) url() string {
+	return "mqtt://" + b.listener.Addr().String()
+}
+
+func (b *fakeBroker) accept() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		b.mu.Lock()
+		b.conns[conn] = nil
+		b.mu.Unlock()
+		go b.serve(conn)
+	}
+}
+
+func (b *fakeBroker) serve(conn net.Conn) {
+	defer b.drop(conn)
+	for {
+		cp, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		switch p := cp.(type) {
+		case *packets.ConnectPacket:
+			b.mu.Lock()
+			b.connects++
+			if p.WillFlag {
+				b.wills[p.WillTopic] = p.WillMessage
+			}
+			b.mu.Unlock()
+			ack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+			ack.Write(conn)
+		case *packets.SubscribePacket:
+			b.mu.Lock()
+			for _, topic := range p.Topics {
+				if !includes(topic, b.conns[conn]) {
+					b.conns[conn] = append(b.conns[conn], topic)
+				}
+			}
+			b.mu.Unlock()
+			ack := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			ack.MessageID = p.MessageID
+			ack.ReturnCodes = p.Qoss
+			ack.Write(conn)
+			for _, topic := range p.Topics {
+				b.subs <- topic
+			}
+		case *packets.PublishPacket:
+			if p.Retain {
+				b.mu.Lock()
+				b.retained[p.TopicName] = p.Payload
+				b.mu.Unlock()
+			}
+			if p.Qos > 0 {
+				ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				ack.MessageID = p.MessageID
+				ack.Write(conn)
+			}
+			select {
+			case b.messages <- p:
+			default:
+			}
+			b.publish(p.TopicName, p.Payload)
+		case *packets.PingreqPacket:
+			packets.NewControlPacket(packets.Pingresp).Write(conn)
+		case *packets.DisconnectPacket:
+			return
+		}
+	}
+}
+
+func (b *fakeBroker) drop(conn net.Conn) {
+	b.mu.Lock()
+	delete(b.conns, conn)
+	b.mu.Unlock()
+	conn.Close()
+}
+
+// publish sends the payload to every connection subscribed to the topic
+func (b *fakeBroker) publish(topic string, payload []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for conn, topics := range b.conns {
+		for _, t := range topics {
+			if t == topic {
+				p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+				p.TopicName = topic
+				p.Payload = payload
+				p.Write(conn)
+			}
+		}
+	}
+}
+
+// waitForSubscription blocks till a client subscribes to the topic
+func (b *fakeBroker) waitForSubscription(topic string) {
+	for {
+		select {
+		case s := <-b.subs:
+			if s == topic {
+				return
+			}
+		case <-time.After(5 * time.Second):
+			b.t.Fatalf("Timed out waiting for subscription to %s", topic)
+		}
+	}
+}
+
+// waitForMessage blocks till a client publishes on the topic
+func (b *fakeBroker) waitForMessage(topic string) *packets.PublishPacket {
+	for {
+		select {
+		case p := <-b.messages:
+			if p.TopicName == topic {
+				return p
+			}
+		case <-time.After(5 * time.Second):
+			b.t.Fatalf("Timed out waiting for message on %s", topic)
+		}
+	}
+}
+
+// bounce drops all the client connections and their subscriptions the same
+// way a broker restart would
+func (b *fakeBroker) bounce() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for conn := range b.conns {
+		conn.Close()
+	}
+	for len(b.subs) > 0 {
+		<-b.subs
+	}
+}
+
+func (b *fakeBroker) close() {
+	b.listener.Close()
+	b.bounce()
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// The configuration is layered, each source overrides the previous one
+//  1. Built in defaults
+//  2. Config file (--config or CATALOG_CONFIG), keys match the flag names
+//  3. Environment variables, CATALOG_ followed by the upper cased flag name
+//  4. Command line flags
+const configFileFlag = "config"
+const envPrefix = "CATALOG_"
+
+// legacyEnvNames are environment variables that were used before the
+// configuration was centralized, they are honored if the CATALOG_ variant
+// is not set
+var legacyEnvNames = map[string]string{
+	"identity": "X_RH_IDENTITY",
+}
+
+// requiredOptions lists the flag names that have to be set by one of the
+// configuration sources
+var requiredOptions = []string{"url", "token", "mqtturl", "guid", "identity"}
+
+// loadConfig builds the CatalogConfig from the command line arguments, the
+// environment and the optional config file
+func loadConfig(args []string) (*CatalogConfig, error) {
+	config := &CatalogConfig{}
+	fs := flag.NewFlagSet("catalog_mqtt_client", flag.ContinueOnError)
+	configFile := fs.String(configFileFlag, "", "Path to a YAML config file")
+	registerFlags(fs, config)
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	if *configFile == "" {
+		*configFile = os.Getenv(envPrefix + "CONFIG")
+	}
+	if *configFile != "" {
+		if err := applyConfigFile(fs, *configFile, explicit); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := applyEnv(fs, explicit); err != nil {
+		return nil, err
+	}
+
+	if err := validateConfig(fs, config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func registerFlags(fs *flag.FlagSet, config *CatalogConfig) {
+	fs.StringVar(&config.Token, "token", "", "Ansible Tower token")
+	fs.StringVar(&config.URL, "url", "", "Ansible Tower URL")
+	fs.BoolVar(&config.Debug, "debug", false, "log debug messages")
+	fs.BoolVar(&config.SkipVerifyCertificate, "skip_verify_ssl", false, "skip tower certificate verification")
+	fs.StringVar(&config.MQTTURL, "mqtturl", "", "MQTTURL")
+	fs.StringVar(&config.GUID, "guid", "", "Client GUID")
+	fs.StringVar(&config.XRHIdentity, "identity", "", "x-rh-identity header used when talking to the task service")
+	fs.StringVar(&config.UploadUser, "upload_user", "", "User for the upload service")
+	fs.StringVar(&config.UploadPassword, "upload_password", "", "Password for the upload service")
+	fs.StringVar(&config.MQTTCACert, "mqtt_ca_cert", "", "CA bundle used to verify the MQTT Server")
+	fs.StringVar(&config.MQTTClientCert, "mqtt_client_cert", "", "Client certificate presented to the MQTT Server")
+	fs.StringVar(&config.MQTTClientKey, "mqtt_client_key", "", "Private key for the MQTT client certificate")
+	fs.StringVar(&config.MQTTServerName, "mqtt_server_name", "", "Override the server name used to verify the MQTT Server")
+	fs.BoolVar(&config.MQTTReconnect, "mqtt_reconnect", true, "reconnect when the connection to the MQTT Server is lost")
+	fs.DurationVar(&config.MQTTReconnectMinInterval, "mqtt_reconnect_min_interval", time.Second, "initial delay between reconnect attempts")
+	fs.DurationVar(&config.MQTTReconnectMaxInterval, "mqtt_reconnect_max_interval", 2*time.Minute, "maximum delay between reconnect attempts")
+	fs.StringVar(&config.StatusTopic, "status_topic", "in/%s/status", "topic for the online/offline status, %s is replaced by the GUID")
+	fs.StringVar(&config.HeartbeatTopic, "heartbeat_topic", "in/%s/heartbeat", "topic for the heartbeats, %s is replaced by the GUID")
+	fs.DurationVar(&config.HeartbeatInterval, "heartbeat_interval", time.Minute, "interval between heartbeats, 0 disables them")
+	fs.IntVar(&config.MaxConcurrentTasks, "max_concurrent_tasks", 5, "number of tasks processed at the same time, 0 is unlimited")
+	fs.DurationVar(&config.TaskTimeout, "task_timeout", 10*time.Minute, "time a task can take before it is canceled, 0 is unlimited")
+	fs.IntVar(&config.MaxWorkersPerTask, "max_workers_per_task", 10, "number of workers running at the same time in a task, 0 is unlimited")
+	fs.IntVar(&config.RetryMaxAttempts, "retry_max_attempts", 3, "number of attempts for a Tower call, 1 disables retries")
+	fs.DurationVar(&config.RetryMinInterval, "retry_min_interval", time.Second, "initial delay between attempts of a Tower call")
+	fs.DurationVar(&config.RetryMaxInterval, "retry_max_interval", 30*time.Second, "maximum delay between attempts of a Tower call")
+	fs.Float64Var(&config.TowerRequestsPerSecond, "tower_requests_per_second", 10, "rate of requests sent to Tower, 0 is unlimited")
+	fs.IntVar(&config.TowerBurst, "tower_burst", 20, "number of requests that can be sent to Tower at once")
+	fs.StringVar(&config.SyncStateFile, "sync_state_file", "", "file storing the time and ids of the last collections, needed for modified_since and report_deletions")
+	config.RetryStatusCodes = StatusCodes{429, 502, 503, 504}
+	fs.Var(&config.RetryStatusCodes, "retry_status_codes", "comma separated HTTP status codes of the Tower calls that are retried")
+}
+
+// StatusCodes is a list of HTTP status codes set from a comma separated string
+type StatusCodes []int
+
+func (sc *StatusCodes) String() string {
+	if sc == nil {
+		return ""
+	}
+	codes := make([]string, len(*sc))
+	for i, code := range *sc {
+		codes[i] = strconv.Itoa(code)
+	}
+	return strings.Join(codes, ",")
+}
+
+// Set replaces the list, the values from the config file can also be a
+// YAML list
+func (sc *StatusCodes) Set(value string) error {
+	var codes StatusCodes
+	fields := strings.FieldsFunc(strings.Trim(value, "[]"), func(r rune) bool { return r == ',' || r == ' ' })
+	for _, f := range fields {
+		code, err := strconv.Atoi(f)
+		if err != nil || code < 100 || code > 599 {
+			return fmt.Errorf("invalid HTTP status code %q", f)
+		}
+		codes = append(codes, code)
+	}
+	*sc = codes
+	return nil
+}
+
+func (sc StatusCodes) includes(code int) bool {
+	for _, c := range sc {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(flagName)
+}
+
+func applyConfigFile(fs *flag.FlagSet, fileName string, explicit map[string]bool) error {
+	b, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return fmt.Errorf("reading config file %s: %v", fileName, err)
+	}
+
+	values := make(map[string]interface{})
+	if err := yaml.Unmarshal(b, &values); err != nil {
+		return fmt.Errorf("parsing config file %s: %v", fileName, err)
+	}
+
+	for key, value := range values {
+		if key == configFileFlag || fs.Lookup(key) == nil {
+			return fmt.Errorf("unknown configuration key %q in %s", key, fileName)
+		}
+		if explicit[key] || value == nil {
+			continue
+		}
+		if err := fs.Set(key, fmt.Sprint(value)); err != nil {
+			return fmt.Errorf("invalid value for %q in %s: %v", key, fileName, err)
+		}
+	}
+	return nil
+}
+
+func applyEnv(fs *flag.FlagSet, explicit map[string]bool) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || f.Name == configFileFlag || explicit[f.Name] {
+			return
+		}
+		name := envName(f.Name)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			if legacy, found := legacyEnvNames[f.Name]; found {
+				name = legacy
+				value, ok = os.LookupEnv(name)
+			}
+		}
+		if !ok {
+			return
+		}
+		if setErr := fs.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("invalid value for environment variable %s: %v", name, setErr)
+		}
+	})
+	return err
+}
+
+func validateConfig(fs *flag.FlagSet, config *CatalogConfig) error {
+	var missing []string
+	for _, name := range requiredOptions {
+		if fs.Lookup(name).Value.String() == "" {
+			missing = append(missing, fmt.Sprintf("%s (flag --%s or env %s)", name, name, envName(name)))
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing required configuration: %s", strings.Join(missing, ", "))
+	}
+
+	for name, value := range map[string]string{"url": config.URL, "mqtturl": config.MQTTURL} {
+		u, err := url.Parse(value)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("invalid configuration %s: %q is not an absolute URL", name, value)
+		}
+	}
+
+	if config.TaskTimeout < 0 {
+		return fmt.Errorf("invalid configuration task_timeout %v can't be negative", config.TaskTimeout)
+	}
+
+	if config.MaxConcurrentTasks < 0 || config.MaxWorkersPerTask < 0 {
+		return fmt.Errorf("invalid configuration max_concurrent_tasks and max_workers_per_task can't be negative")
+	}
+
+	if config.RetryMaxAttempts < 1 {
+		return fmt.Errorf("invalid configuration retry_max_attempts %d has to be at least 1", config.RetryMaxAttempts)
+	}
+
+	if config.RetryMinInterval < 0 || config.RetryMaxInterval < config.RetryMinInterval {
+		return fmt.Errorf("invalid configuration retry_min_interval %v and retry_max_interval %v",
+			config.RetryMinInterval, config.RetryMaxInterval)
+	}
+
+	if config.TowerRequestsPerSecond < 0 || config.TowerBurst < 1 {
+		return fmt.Errorf("invalid configuration tower_requests_per_second %v can't be negative and tower_burst %d has to be at least 1",
+			config.TowerRequestsPerSecond, config.TowerBurst)
+	}
+
+	if config.MQTTReconnectMinInterval <= 0 || config.MQTTReconnectMaxInterval < config.MQTTReconnectMinInterval {
+		return fmt.Errorf("invalid configuration mqtt_reconnect_min_interval %v and mqtt_reconnect_max_interval %v",
+			config.MQTTReconnectMinInterval, config.MQTTReconnectMaxInterval)
+	}
+	return nil
+}
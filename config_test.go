@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var requiredArgs = []string{
+	"--token", "gobbledygook",
+	"--url", "https://www.example.com",
+	"--mqtturl", "tcp://localhost:1883",
+	"--guid", "123",
+	"--identity", "abc",
+}
+
+func writeConfigFile(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "catalog_config")
+	if err != nil {
+		t.Fatalf("Error creating temp directory %v", err)
+	}
+	name := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatalf("Error writing config file %v", err)
+	}
+	return name
+}
+
+func TestConfigFlags(t *testing.T) {
+	config, err := loadConfig(append([]string{"--debug"}, requiredArgs...))
+	if err != nil {
+		t.Fatalf("Error loading config %v", err)
+	}
+	if !config.Debug {
+		t.Errorf("Debug is not being enabled")
+	}
+	if config.URL != "https://www.example.com" {
+		t.Errorf("URL has not been set")
+	}
+	if config.Token != "gobbledygook" {
+		t.Errorf("Token has not been set")
+	}
+}
+
+func TestConfigMissing(t *testing.T) {
+	_, err := loadConfig([]string{"--url", "https://www.example.com"})
+	if err == nil {
+		t.Fatalf("Loading config should have failed")
+	}
+	for _, name := range []string{"token", "mqtturl", "guid", "identity"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("Error %v does not name missing field %s", err, name)
+		}
+	}
+	if strings.Contains(err.Error(), " url (") {
+		t.Errorf("Error %v should not name url", err)
+	}
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	name := writeConfigFile(t, "token: from_file\nguid: file_guid\ndebug: true\nupload_user: fred\n")
+	defer os.RemoveAll(filepath.Dir(name))
+	os.Setenv("CATALOG_GUID", "env_guid")
+	os.Setenv("X_RH_IDENTITY", "legacy")
+	defer os.Unsetenv("CATALOG_GUID")
+	defer os.Unsetenv("X_RH_IDENTITY")
+
+	config, err := loadConfig([]string{"--config", name,
+		"--url", "https://www.example.com",
+		"--mqtturl", "tcp://localhost:1883",
+		"--token", "from_flag"})
+	if err != nil {
+		t.Fatalf("Error loading config %v", err)
+	}
+	if config.Token != "from_flag" {
+		t.Errorf("Flag should override config file, got %s", config.Token)
+	}
+	if config.GUID != "env_guid" {
+		t.Errorf("Environment should override config file, got %s", config.GUID)
+	}
+	if config.XRHIdentity != "legacy" {
+		t.Errorf("Legacy environment variable not honored, got %s", config.XRHIdentity)
+	}
+	if !config.Debug || config.UploadUser != "fred" {
+		t.Errorf("Config file values not applied")
+	}
+}
+
+func TestConfigFileUnknownKey(t *testing.T) {
+	name := writeConfigFile(t, "tokn: abc\n")
+	defer os.RemoveAll(filepath.Dir(name))
+	_, err := loadConfig(append([]string{"--config", name}, requiredArgs...))
+	if err == nil || !strings.Contains(err.Error(), `"tokn"`) {
+		t.Fatalf("Expected unknown key error got %v", err)
+	}
+}
+
+func TestConfigInvalidURL(t *testing.T) {
+	_, err := loadConfig(append(requiredArgs, "--mqtturl", "localhost"))
+	if err == nil || !strings.Contains(err.Error(), "mqtturl") {
+		t.Fatalf("Expected invalid mqtturl error got %v", err)
+	}
+}
+
+func TestConfigRetryStatusCodes(t *testing.T) {
+	config, err := loadConfig(requiredArgs)
+	if err != nil {
+		t.Fatalf("Error loading config %v", err)
+	}
+	if config.RetryStatusCodes.String() != "429,502,503,504" {
+		t.Errorf("Unexpected default retry status codes %s", config.RetryStatusCodes.String())
+	}
+
+	name := writeConfigFile(t, "retry_status_codes: [500, 503]\n")
+	defer os.RemoveAll(filepath.Dir(name))
+	config, err = loadConfig(append([]string{"--config", name}, requiredArgs...))
+	if err != nil {
+		t.Fatalf("Error loading config %v", err)
+	}
+	if !config.RetryStatusCodes.includes(500) || config.RetryStatusCodes.includes(429) {
+		t.Errorf("Retry status codes not set from config file, got %s", config.RetryStatusCodes.String())
+	}
+
+	_, err = loadConfig(append(requiredArgs, "--retry_status_codes", "503,abc"))
+	if err == nil || !strings.Contains(err.Error(), "abc") {
+		t.Fatalf("Expected invalid status code error got %v", err)
+	}
+}
@@ -3,9 +3,9 @@ module github.com/mkanoor/catalog_mqtt_client
 go 1.14
 
 require (
-	github.com/eclipse/paho.mqtt.golang v1.2.0 // indirect
-	github.com/google/uuid v1.1.2 // indirect
+	github.com/eclipse/paho.mqtt.golang v1.2.0
 	github.com/jmespath/go-jmespath v0.4.0
 	github.com/sirupsen/logrus v1.7.0
-	golang.org/x/net v0.0.0-20201110031124-69a78807bb2b // indirect
+	golang.org/x/net v0.0.0-20201110031124-69a78807bb2b
+	gopkg.in/yaml.v2 v2.3.0
 )
@@ -0,0 +1,42 @@
+package backoff
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Backoff computes exponentially growing delays between attempts. Each delay
+// is randomized between half and the full exponential value so that many
+// clients don't retry in lock step.
+type Backoff struct {
+	Min     time.Duration
+	Max     time.Duration
+	attempt int
+}
+
+// Next returns the delay to wait before the next attempt
+func (b *Backoff) Next() time.Duration {
+	d := b.Min
+	for i := 0; i < b.attempt && d < b.Max; i++ {
+		d *= 2
+	}
+	if d > b.Max {
+		d = b.Max
+	}
+	b.attempt++
+	if d <= 1 {
+		return d
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
+
+// Attempts returns the number of delays handed out since the last Reset
+func (b *Backoff) Attempts() int {
+	return b.attempt
+}
+
+// Reset starts the delays from the minimum again
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}
@@ -0,0 +1,31 @@
+package backoff
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffGrows(t *testing.T) {
+	b := Backoff{Min: 100 * time.Millisecond, Max: time.Second}
+	expected := []time.Duration{100, 200, 400, 800, 1000, 1000}
+	for i, e := range expected {
+		max := e * time.Millisecond
+		d := b.Next()
+		if d < max/2 || d > max {
+			t.Errorf("Attempt %d delay %v not between %v and %v", i, d, max/2, max)
+		}
+	}
+	if b.Attempts() != len(expected) {
+		t.Errorf("Attempts should be %d got %d", len(expected), b.Attempts())
+	}
+}
+
+func TestBackoffReset(t *testing.T) {
+	b := Backoff{Min: 100 * time.Millisecond, Max: time.Second}
+	b.Next()
+	b.Next()
+	b.Reset()
+	if d := b.Next(); d > 100*time.Millisecond {
+		t.Errorf("Delay after reset should not exceed the minimum, got %v", d)
+	}
+}
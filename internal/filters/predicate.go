@@ -0,0 +1,75 @@
+package filters
+
+import (
+	"encoding/json"
+
+	"github.com/jmespath/go-jmespath"
+)
+
+// Predicate is a JMESPath expression deciding if an object is selected
+type Predicate struct {
+	Data       string
+	expression *jmespath.JMESPath
+}
+
+// NewPredicate compiles the JMESPath expression of the predicate
+func NewPredicate(data string) (*Predicate, error) {
+	expression, err := jmespath.Compile(data)
+	if err != nil {
+		return nil, err
+	}
+	return &Predicate{Data: data, expression: expression}, nil
+}
+
+// Match evaluates the expression against the object, the result is
+// converted to a bool with the JMESPath truthiness rules
+func (p *Predicate) Match(obj interface{}) (bool, error) {
+	result, err := p.expression.Search(numbersToFloat(obj))
+	if err != nil {
+		return false, err
+	}
+	return Truthy(result), nil
+}
+
+// Truthy follows JMESPath, null, false, empty strings, empty lists and
+// empty objects are false, everything else including 0 is true
+func Truthy(v interface{}) bool {
+	switch value := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return value
+	case string:
+		return value != ""
+	case []interface{}:
+		return len(value) > 0
+	case map[string]interface{}:
+		return len(value) > 0
+	}
+	return true
+}
+
+// numbersToFloat converts the json.Number values of a body decoded with
+// UseNumber so JMESPath can compare them
+func numbersToFloat(v interface{}) interface{} {
+	switch value := v.(type) {
+	case json.Number:
+		if f, err := value.Float64(); err == nil {
+			return f
+		}
+		return value.String()
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(value))
+		for k, e := range value {
+			result[k] = numbersToFloat(e)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(value))
+		for i, e := range value {
+			result[i] = numbersToFloat(e)
+		}
+		return result
+	}
+	return v
+}
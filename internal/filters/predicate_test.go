@@ -0,0 +1,57 @@
+package filters
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestPredicate(t *testing.T) {
+	body := `{"id": 7, "type": "job_template", "survey_enabled": true, "labels": [], "name": "", "forks": 0}`
+	var obj map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader([]byte(body)))
+	decoder.UseNumber()
+	if err := decoder.Decode(&obj); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		expression string
+		expected   bool
+	}{
+		{"survey_enabled", true},
+		{"survey_enabled && type=='job_template'", true},
+		{"survey_enabled && type=='workflow_job_template'", false},
+		{"id > `5`", true},
+		{"labels", false},
+		{"name", false},
+		{"forks", true},
+		{"missing", false},
+		{"type", true},
+	}
+	for _, tt := range tests {
+		p, err := NewPredicate(tt.expression)
+		if err != nil {
+			t.Fatalf("Error compiling %s %v", tt.expression, err)
+		}
+		matched, err := p.Match(obj)
+		if err != nil {
+			t.Fatalf("Error evaluating %s %v", tt.expression, err)
+		}
+		if matched != tt.expected {
+			t.Errorf("%s should be %v", tt.expression, tt.expected)
+		}
+	}
+}
+
+func TestPredicateErrors(t *testing.T) {
+	if _, err := NewPredicate("survey_enabled &&"); err == nil {
+		t.Error("Compiling an invalid expression did not fail")
+	}
+	p, err := NewPredicate("length(id)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Match(map[string]interface{}{"id": json.Number("7")}); err == nil {
+		t.Error("Evaluating a function with the wrong type did not fail")
+	}
+}
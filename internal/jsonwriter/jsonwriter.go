@@ -5,24 +5,26 @@ import (
 	"encoding/json"
 
 	"github.com/mkanoor/catalog_mqtt_client/internal/logger"
+	"github.com/mkanoor/catalog_mqtt_client/internal/taskerror"
 	"github.com/mkanoor/catalog_mqtt_client/internal/taskupdater"
 )
 
 type JSONWriter struct {
-	Url  string
-	glog logger.Logger
-	ctx  context.Context
+	Url      string
+	identity string
+	glog     logger.Logger
+	ctx      context.Context
 }
 
-func MakeJSONWriter(ctx context.Context, url string) *JSONWriter {
+func MakeJSONWriter(ctx context.Context, url string, identity string) *JSONWriter {
 	glog := logger.GetLogger(ctx)
 
-	return &JSONWriter{Url: url, glog: glog, ctx: ctx}
+	return &JSONWriter{Url: url, identity: identity, glog: glog, ctx: ctx}
 }
 
 // Write a Page given the name and the number of bytes to write
 func (jw *JSONWriter) Write(name string, b []byte) error {
-	tu := taskupdater.TaskUpdater{Url: jw.Url}
+	tu := taskupdater.MakeTaskUpdater(jw.ctx, jw.Url, jw.identity)
 	var m map[string]interface{}
 	err := json.Unmarshal(b, &m)
 	if err != nil {
@@ -37,9 +39,12 @@ func (jw *JSONWriter) Write(name string, b []byte) error {
 	return nil
 }
 
-func (jw *JSONWriter) Flush() error {
-	tu := taskupdater.TaskUpdater{Url: jw.Url}
-	_, err := tu.Do("completed", "ok", nil)
+// Flush marks the task as completed with the outcome of the jobs, the
+// pages have already been sent
+func (jw *JSONWriter) Flush(ctx context.Context, jobs []*taskerror.Outcome) error {
+	tu := taskupdater.MakeTaskUpdater(jw.ctx, jw.Url, jw.identity)
+	msg := map[string]interface{}{"jobs": jobs}
+	_, err := tu.Do("completed", "ok", &msg)
 	if err != nil {
 		jw.glog.Errorf("Error updating task %s %v", jw.Url, err)
 		return err
@@ -47,12 +52,26 @@ func (jw *JSONWriter) Flush() error {
 	return nil
 }
 
-func (jw *JSONWriter) FlushErrors(messages []string) error {
-	tu := taskupdater.TaskUpdater{Url: jw.Url}
+func (jw *JSONWriter) FlushErrors(errs []*taskerror.Error, jobs []*taskerror.Outcome) error {
+	return jw.Abort("completed", errs, jobs)
+}
+
+// FlushPartial is the same as FlushErrors, the pages that were collected
+// have already been sent
+func (jw *JSONWriter) FlushPartial(ctx context.Context, errs []*taskerror.Error, jobs []*taskerror.Outcome) error {
+	return jw.FlushErrors(errs, jobs)
+}
+
+// Abort updates the task with the state, the errors and the outcome of
+// the jobs
+func (jw *JSONWriter) Abort(state string, errs []*taskerror.Error, jobs []*taskerror.Outcome) error {
+	tu := taskupdater.MakeTaskUpdater(jw.ctx, jw.Url, jw.identity)
 	msg := map[string]interface{}{
-		"messages": messages,
+		"messages": taskerror.Messages(errs),
+		"errors":   errs,
+		"jobs":     jobs,
 	}
-	_, err := tu.Do("completed", "error", &msg)
+	_, err := tu.Do(state, "error", &msg)
 	if err != nil {
 		jw.glog.Errorf("Error updating task %s %v", jw.Url, err)
 		return err
@@ -0,0 +1,115 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// minRateDivisor limits how far the rate can be lowered by Slowdown
+const minRateDivisor = 16
+
+// Limiter is a token bucket shared by all the requests made to a server.
+// The bucket holds up to burst tokens and is refilled at rate tokens per
+// second, every request takes a token. The rate is lowered when the server
+// asks the client to slow down and slowly recovers afterwards.
+// A nil Limiter doesn't limit anything.
+type Limiter struct {
+	mu      sync.Mutex
+	maxRate float64
+	rate    float64
+	burst   float64
+	tokens  float64
+	last    time.Time
+}
+
+// New creates a Limiter, it returns nil if the rate is not positive
+func New(rate float64, burst int) *Limiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{
+		maxRate: rate,
+		rate:    rate,
+		burst:   float64(burst),
+		tokens:  float64(burst),
+		last:    time.Now(),
+	}
+}
+
+// Wait blocks till a token is available or the ctx is done
+func (l *Limiter) Wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	for {
+		l.mu.Lock()
+		l.refill(time.Now())
+		if l.tokens >= 1 {
+			l.tokens--
+			l.mu.Unlock()
+			return nil
+		}
+		wait := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+		l.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Slowdown halves the rate and empties the bucket
+func (l *Limiter) Slowdown() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	l.rate /= 2
+	if min := l.maxRate / minRateDivisor; l.rate < min {
+		l.rate = min
+	}
+	l.tokens = 0
+}
+
+// Speedup raises the rate by a tenth of the configured rate
+func (l *Limiter) Speedup() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate >= l.maxRate {
+		return
+	}
+	l.refill(time.Now())
+	l.rate += l.maxRate / 10
+	if l.rate > l.maxRate {
+		l.rate = l.maxRate
+	}
+}
+
+// Rate returns the current number of requests allowed per second
+func (l *Limiter) Rate() float64 {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+func (l *Limiter) refill(now time.Time) {
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+}
@@ -0,0 +1,73 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBurst(t *testing.T) {
+	l := New(10, 5)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := l.Wait(context.Background()); err != nil {
+			t.Fatalf("Wait failed %v", err)
+		}
+	}
+	if time.Since(start) > 50*time.Millisecond {
+		t.Fatalf("The burst should not have been limited")
+	}
+}
+
+func TestRate(t *testing.T) {
+	l := New(50, 1)
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		l.Wait(context.Background())
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Fatalf("6 requests at 50 per second should take at least 100ms, took %v", elapsed)
+	}
+}
+
+func TestSlowdownAndSpeedup(t *testing.T) {
+	l := New(16, 1)
+	l.Slowdown()
+	if l.Rate() != 8 {
+		t.Fatalf("Rate should have been halved got %v", l.Rate())
+	}
+	for i := 0; i < 10; i++ {
+		l.Slowdown()
+	}
+	if l.Rate() != 1 {
+		t.Fatalf("Rate should not go below a 16th of the configured rate got %v", l.Rate())
+	}
+	for i := 0; i < 20; i++ {
+		l.Speedup()
+	}
+	if l.Rate() != 16 {
+		t.Fatalf("Rate should have recovered to the configured rate got %v", l.Rate())
+	}
+}
+
+func TestWaitCanceled(t *testing.T) {
+	l := New(0.1, 1)
+	l.Wait(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := l.Wait(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Wait should have been canceled got %v", err)
+	}
+}
+
+func TestNilLimiter(t *testing.T) {
+	var l *Limiter = New(0, 0)
+	if l != nil {
+		t.Fatalf("A rate of 0 should not limit")
+	}
+	if err := l.Wait(context.Background()); err != nil {
+		t.Fatalf("Wait failed %v", err)
+	}
+	l.Slowdown()
+	l.Speedup()
+}
@@ -0,0 +1,94 @@
+package syncstate
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Entry is the state of the last successful collection of a href_slug
+type Entry struct {
+	LastSync time.Time `json:"last_sync"`
+	IDs      []int64   `json:"ids,omitempty"`
+}
+
+// Store keeps the sync state of every href_slug in a JSON file
+type Store struct {
+	path    string
+	mu      sync.Mutex
+	entries map[string]Entry
+}
+
+// Open loads the state from the file, a missing file is an empty state
+func Open(path string) (*Store, error) {
+	s := &Store{path: path, entries: make(map[string]Entry)}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &s.entries); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Get returns the state of a href_slug
+func (s *Store) Get(href string) (Entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[href]
+	return e, ok
+}
+
+// Update sets the state of the href_slugs and saves the file
+func (s *Store) Update(entries map[string]Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for href, e := range entries {
+		s.entries[href] = e
+	}
+	return s.save()
+}
+
+// save writes to a temporary file and renames it so that the state is
+// never left half written
+func (s *Store) save() error {
+	b, err := json.Marshal(s.entries)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// Deleted returns the ids from before that are missing from now
+func Deleted(before []int64, now []int64) []int64 {
+	current := make(map[int64]bool, len(now))
+	for _, id := range now {
+		current[id] = true
+	}
+	deleted := []int64{}
+	for _, id := range before {
+		if !current[id] {
+			deleted = append(deleted, id)
+		}
+	}
+	return deleted
+}
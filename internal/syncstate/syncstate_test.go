@@ -0,0 +1,52 @@
+package syncstate
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncstate")
+	if err != nil {
+		t.Fatalf("Error creating temp directory %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	s, err := Open(path)
+	if err != nil {
+		t.Fatalf("Opening a missing file should not fail %v", err)
+	}
+	if _, ok := s.Get("/api/v2/hosts/"); ok {
+		t.Fatalf("State should be empty")
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	err = s.Update(map[string]Entry{"/api/v2/hosts/": {LastSync: now, IDs: []int64{1, 2}}})
+	if err != nil {
+		t.Fatalf("Error saving state %v", err)
+	}
+
+	s, err = Open(path)
+	if err != nil {
+		t.Fatalf("Error loading state %v", err)
+	}
+	e, ok := s.Get("/api/v2/hosts/")
+	if !ok || !e.LastSync.Equal(now) || !reflect.DeepEqual(e.IDs, []int64{1, 2}) {
+		t.Fatalf("State was not saved got %v", e)
+	}
+}
+
+func TestDeleted(t *testing.T) {
+	deleted := Deleted([]int64{1, 2, 3, 4}, []int64{2, 4, 5})
+	if !reflect.DeepEqual(deleted, []int64{1, 3}) {
+		t.Fatalf("Expected 1 and 3 to be deleted got %v", deleted)
+	}
+	if deleted := Deleted(nil, []int64{1}); len(deleted) != 0 {
+		t.Fatalf("Nothing should be deleted got %v", deleted)
+	}
+}
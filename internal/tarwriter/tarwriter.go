@@ -9,6 +9,7 @@ import (
 
 	"github.com/mkanoor/catalog_mqtt_client/internal/logger"
 	"github.com/mkanoor/catalog_mqtt_client/internal/tarfiles"
+	"github.com/mkanoor/catalog_mqtt_client/internal/taskerror"
 	"github.com/mkanoor/catalog_mqtt_client/internal/taskupdater"
 	"github.com/mkanoor/catalog_mqtt_client/internal/upload"
 )
@@ -17,11 +18,13 @@ type TarWriter struct {
 	dir       string
 	Url       string
 	uploadUrl string
+	identity  string
+	creds     upload.Credentials
 	ctx       context.Context
 	glog      logger.Logger
 }
 
-func MakeTarWriter(ctx context.Context, url string, uploadUrl string) (*TarWriter, error) {
+func MakeTarWriter(ctx context.Context, url string, uploadUrl string, identity string, creds upload.Credentials) (*TarWriter, error) {
 	glog := logger.GetLogger(ctx)
 	t := TarWriter{}
 	dir, err := ioutil.TempDir("", "catalog_client")
@@ -32,6 +35,8 @@ func MakeTarWriter(ctx context.Context, url string, uploadUrl string) (*TarWrite
 	t.dir = dir
 	t.Url = url
 	t.uploadUrl = uploadUrl
+	t.identity = identity
+	t.creds = creds
 	t.ctx = ctx
 	t.glog = glog
 	return &t, nil
@@ -50,39 +55,83 @@ func (tw *TarWriter) Write(name string, b []byte) error {
 	return nil
 }
 
-func (tw *TarWriter) Flush() error {
+// errorsManifest is the file with the errors added to a partial upload
+const errorsManifest = "errors.json"
+
+// Flush compresses the pages and uploads them, the upload is aborted
+// if ctx is canceled
+func (tw *TarWriter) Flush(ctx context.Context, jobs []*taskerror.Outcome) error {
+	m, err := tw.upload(ctx)
+	if err != nil {
+		tw.Abort("completed", []*taskerror.Error{taskerror.New(taskerror.Upload, err.Error())}, jobs)
+		return err
+	}
+	m["jobs"] = jobs
+	return tw.update("completed", "ok", m)
+}
+
+// FlushPartial uploads the pages that were collected along with a manifest
+// of the errors, the task gets the upload result and the errors so the
+// cloud can decide if it accepts the partial inventory
+func (tw *TarWriter) FlushPartial(ctx context.Context, errs []*taskerror.Error, jobs []*taskerror.Outcome) error {
+	manifest, err := json.Marshal(map[string]interface{}{"errors": errs, "jobs": jobs})
+	if err == nil {
+		err = tw.Write(errorsManifest, manifest)
+	}
+	if err != nil {
+		tw.glog.Errorf("Error creating errors manifest %v", err)
+		tw.Abort("completed", append(errs, taskerror.New(taskerror.Upload, err.Error())), jobs)
+		return err
+	}
+	m, err := tw.upload(ctx)
+	if err != nil {
+		tw.Abort("completed", append(errs, taskerror.New(taskerror.Upload, err.Error())), jobs)
+		return err
+	}
+	m["partial"] = true
+	m["messages"] = taskerror.Messages(errs)
+	m["errors"] = errs
+	m["jobs"] = jobs
+	return tw.update("completed", "error", m)
+}
+
+// upload compresses the pages and uploads them, the caller reports a
+// failed upload on the task
+func (tw *TarWriter) upload(ctx context.Context) (map[string]interface{}, error) {
+	defer os.RemoveAll(tw.dir)
 	tmpdir, err := ioutil.TempDir("", "catalog_client_tgz")
 	if err != nil {
 		tw.glog.Errorf("Error creating temp directory %v", err)
-		return err
+		return nil, err
 	}
+	defer os.RemoveAll(tmpdir)
 	fname := filepath.Join(tmpdir, "inventory.tgz")
 	err = tarfiles.TarCompressDirectory(tw.dir, fname)
 	if err != nil {
 		tw.glog.Errorf("Error compressing directory %s %v", tw.dir, err)
 	}
 
-	tu := taskupdater.MakeTaskUpdater(tw.ctx, tw.Url)
 	//_, err = upload.Upload(tw.uploadUrl, fname, "application/vnd.redhat.catalog.filename+tgz")
-	b, uploadErr := upload.Upload(tw.uploadUrl, fname, "application/vnd.redhat.topological-inventory.filename+tgz")
-	if uploadErr != nil {
-		tw.glog.Errorf("Error uploading file %s %v", fname, uploadErr)
+	b, err := upload.Upload(ctx, tw.uploadUrl, fname, "application/vnd.redhat.topological-inventory.filename+tgz", tw.creds)
+	if err != nil {
+		tw.glog.Errorf("Error uploading file %s %v", fname, err)
+		return nil, err
 	}
-	os.RemoveAll(tw.dir)
-	os.RemoveAll(tmpdir)
 	var m map[string]interface{}
 	err = json.Unmarshal(b, &m)
 	if err != nil {
 		tw.glog.Errorf("Unmarshaling byte array for %v", err)
-		return err
+		return nil, err
 	}
-
-	if uploadErr == nil {
-		_, err = tu.Do("completed", "ok", &m)
-	} else {
-		_, err = tu.Do("completed", "error", &map[string]interface{}{"message": uploadErr.Error()})
+	if m == nil {
+		m = make(map[string]interface{})
 	}
+	return m, nil
+}
 
+func (tw *TarWriter) update(state string, status string, result map[string]interface{}) error {
+	tu := taskupdater.MakeTaskUpdater(tw.ctx, tw.Url, tw.identity)
+	_, err := tu.Do(state, status, &result)
 	if err != nil {
 		tw.glog.Errorf("Error updating task %s %v", tw.Url, err)
 		return err
@@ -90,16 +139,17 @@ func (tw *TarWriter) Flush() error {
 	return nil
 }
 
-func (tw *TarWriter) FlushErrors(messages []string) error {
+func (tw *TarWriter) FlushErrors(errs []*taskerror.Error, jobs []*taskerror.Outcome) error {
+	return tw.Abort("completed", errs, jobs)
+}
+
+// Abort discards the pages and updates the task with the state, the
+// errors and the outcome of the jobs
+func (tw *TarWriter) Abort(state string, errs []*taskerror.Error, jobs []*taskerror.Outcome) error {
 	os.RemoveAll(tw.dir)
-	tu := taskupdater.TaskUpdater{Url: tw.Url}
-	msg := map[string]interface{}{
-		"messages": messages,
-	}
-	_, err := tu.Do("completed", "error", &msg)
-	if err != nil {
-		tw.glog.Errorf("Error updating task %s %v", tw.Url, err)
-		return err
-	}
-	return nil
+	return tw.update(state, "error", map[string]interface{}{
+		"messages": taskerror.Messages(errs),
+		"errors":   errs,
+		"jobs":     jobs,
+	})
 }
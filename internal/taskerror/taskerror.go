@@ -0,0 +1,88 @@
+package taskerror
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// The categories of the errors reported in the task result
+const (
+	Tower      = "tower"      // Tower answered with an unexpected status
+	Transport  = "transport"  // Tower could not be reached
+	Validation = "validation" // The job parameters are not valid
+	Data       = "data"       // The data sent by Tower could not be processed
+	Panic      = "panic"      // A worker crashed
+	Internal   = "internal"   // Any other failure of a job
+	Canceled   = "canceled"   // The task was canceled
+	Timeout    = "timeout"    // The task took too long
+	Shutdown   = "shutdown"   // The client is shutting down
+	Upload     = "upload"     // The pages could not be uploaded
+)
+
+// Error is a failure reported in the task result, it is sent as JSON
+type Error struct {
+	Category string      `json:"category"`
+	Message  string      `json:"message"`
+	Job      string      `json:"job,omitempty"`
+	Method   string      `json:"method,omitempty"`
+	URL      string      `json:"url,omitempty"`
+	Status   int         `json:"status,omitempty"`
+	Body     interface{} `json:"body,omitempty"`
+
+	JobID int `json:"-"` // The job of the task that failed, 0 for the task itself
+}
+
+// New creates an error that isn't tied to a job
+func New(category string, message string) *Error {
+	return &Error{Category: category, Message: message}
+}
+
+func (e *Error) Error() string {
+	s := fmt.Sprintf("URL : %s Status: %d Message: %s", e.Job, e.Status, e.Message)
+	if e.Body != nil {
+		b, _ := json.Marshal(e.Body)
+		s += " Body: " + string(b)
+	}
+	return s
+}
+
+// SetBody keeps the body sent by Tower as JSON, or as a string if it
+// isn't JSON
+func (e *Error) SetBody(body []byte) {
+	if len(body) == 0 {
+		return
+	}
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		e.Body = string(body)
+		return
+	}
+	e.Body = v
+}
+
+// Messages returns the errors as strings
+func Messages(errs []*Error) []string {
+	messages := make([]string, len(errs))
+	for i, e := range errs {
+		messages[i] = e.Error()
+	}
+	return messages
+}
+
+// The status of a job in its outcome
+const (
+	StatusOK         = "ok"
+	StatusError      = "error"
+	StatusIncomplete = "incomplete"
+)
+
+// Outcome is the result of a job of the task, it is sent with the errors
+// so the cloud can tell which jobs failed
+type Outcome struct {
+	HrefSlug        string   `json:"href_slug"`
+	Method          string   `json:"method"`
+	Status          string   `json:"status"`
+	Pages           int      `json:"pages"`
+	DurationSeconds float64  `json:"duration_seconds"`
+	Errors          []*Error `json:"errors,omitempty"`
+}
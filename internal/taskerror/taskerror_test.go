@@ -0,0 +1,34 @@
+package taskerror
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestSetBody(t *testing.T) {
+	e := &Error{Category: Tower, Message: "HTTP GET call failed with 400", Job: "/api/v2/jobs/1/", Status: 400}
+	e.SetBody([]byte(`{"detail": "Bad request"}`))
+	b, err := json.Marshal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"body":{"detail":"Bad request"}`) {
+		t.Errorf("The body should be kept as JSON %s", string(b))
+	}
+	if !strings.Contains(e.Error(), "Status: 400") || !strings.Contains(e.Error(), "Bad request") {
+		t.Errorf("Unexpected message %s", e.Error())
+	}
+
+	e.SetBody([]byte("<html>Bad Gateway</html>"))
+	if e.Body != "<html>Bad Gateway</html>" {
+		t.Errorf("A body that isn't JSON should be kept as a string %v", e.Body)
+	}
+}
+
+func TestMessages(t *testing.T) {
+	messages := Messages([]*Error{New(Canceled, "Task canceled")})
+	if len(messages) != 1 || !strings.Contains(messages[0], "Task canceled") {
+		t.Errorf("Unexpected messages %v", messages)
+	}
+}
@@ -7,21 +7,21 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"os"
 
 	"github.com/mkanoor/catalog_mqtt_client/internal/logger"
 )
 
 type TaskUpdater struct {
-	Url  string
-	ctx  context.Context
-	glog logger.Logger
+	Url      string
+	Identity string
+	ctx      context.Context
+	glog     logger.Logger
 }
 
-func MakeTaskUpdater(ctx context.Context, url string) *TaskUpdater {
+func MakeTaskUpdater(ctx context.Context, url string, identity string) *TaskUpdater {
 	glog := logger.GetLogger(ctx)
 
-	return &TaskUpdater{Url: url, glog: glog, ctx: ctx}
+	return &TaskUpdater{Url: url, Identity: identity, glog: glog, ctx: ctx}
 }
 
 // Write a Page given the name and the number of bytes to write
@@ -45,19 +45,18 @@ func (tu *TaskUpdater) Do(state string, status string, result *map[string]interf
 		return nil, err
 	}
 	client := &http.Client{}
-	req, err := http.NewRequest(http.MethodPatch, tu.Url, bytes.NewBuffer(payload))
-	req.Header.Set("Content-Type", "application/json")
-	xrh := os.Getenv("X_RH_IDENTITY")
-	if xrh == "" {
-		err = fmt.Errorf("Environmental variable X_RH_IDENTITY is not set")
-		tu.glog.Errorf("%v", err)
-		return nil, err
-	}
-	req.Header.Set("x-rh-identity", xrh)
+	req, err := http.NewRequestWithContext(tu.ctx, http.MethodPatch, tu.Url, bytes.NewBuffer(payload))
 	if err != nil {
 		tu.glog.Errorf("Error creating a new request %v", err)
 		return nil, err
 	}
+	req.Header.Set("Content-Type", "application/json")
+	if tu.Identity == "" {
+		err = fmt.Errorf("The identity for the task service is not configured")
+		tu.glog.Errorf("%v", err)
+		return nil, err
+	}
+	req.Header.Set("x-rh-identity", tu.Identity)
 
 	resp, err := client.Do(req)
 	if err != nil {
@@ -1,6 +1,7 @@
 package upload
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -12,7 +13,20 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-func Upload(url string, name string, contentType string) ([]byte, error) {
+// Credentials used to authenticate with the upload service
+type Credentials struct {
+	User     string
+	Password string
+}
+
+func Upload(ctx context.Context, url string, name string, contentType string, creds Credentials) ([]byte, error) {
+	if creds.User == "" {
+		return nil, fmt.Errorf("The user for the upload service is not configured")
+	}
+	if creds.Password == "" {
+		return nil, fmt.Errorf("The password for the upload service is not configured")
+	}
+
 	r, w := io.Pipe()
 	m := multipart.NewWriter(w)
 	go func() {
@@ -34,23 +48,15 @@ func Upload(url string, name string, contentType string) ([]byte, error) {
 		}
 	}()
 
-	req, err := http.NewRequest("POST", url, r)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, r)
 	if err != nil {
+		// Unblock the writer
+		r.CloseWithError(err)
 		return nil, err
 	}
 	fmt.Println(m.FormDataContentType())
 	req.Header.Set("Content-Type", m.FormDataContentType())
-	user := os.Getenv("USER")
-	if user == "" {
-		err = fmt.Errorf("Environmental variable USER is not set")
-		return nil, err
-	}
-	password := os.Getenv("PASSWORD")
-	if user == "" {
-		err = fmt.Errorf("Environmental variable PASSWORD is not set")
-		return nil, err
-	}
-	req.SetBasicAuth(user, password)
+	req.SetBasicAuth(creds.User, creds.Password)
 	client := &http.Client{}
 	res, err := client.Do(req)
 	if err != nil {
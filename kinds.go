@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/mkanoor/catalog_mqtt_client/internal/logger"
+	"github.com/mkanoor/catalog_mqtt_client/internal/taskerror"
+	"github.com/mkanoor/catalog_mqtt_client/internal/taskupdater"
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultKind is used for messages that don't specify a kind
+const defaultKind = "catalog"
+
+// MessageEnv has everything the message handlers need from the listener
+type MessageEnv struct {
+	client   mqtt.Client
+	config   *CatalogConfig
+	wh       WorkHandler
+	shutdown chan struct{}
+	slots    chan struct{}
+}
+
+// MessageHandler processes the MQTT messages of a single kind, new kinds
+// are added by registering a handler with RegisterMessageHandler
+type MessageHandler interface {
+	HandleMessage(ctx context.Context, m MQTTMessage, env *MessageEnv) error
+}
+
+var messageHandlers = make(map[string]MessageHandler)
+
+// RegisterMessageHandler registers the handler for a message kind, it is
+// meant to be called from init
+func RegisterMessageHandler(kind string, h MessageHandler) {
+	kind = strings.ToLower(kind)
+	if _, ok := messageHandlers[kind]; ok {
+		panic("Message handler already registered for kind " + kind)
+	}
+	messageHandlers[kind] = h
+}
+
+func init() {
+	RegisterMessageHandler("catalog", &catalogHandler{})
+	RegisterMessageHandler("cancel", &cancelHandler{})
+	RegisterMessageHandler("ping", &pingHandler{})
+	RegisterMessageHandler("config", &configHandler{})
+}
+
+// routeMessage hands the message to the handler registered for its kind,
+// messages of an unknown kind are rejected
+func routeMessage(ctx context.Context, m MQTTMessage, env *MessageEnv) error {
+	glog := logger.GetLogger(ctx)
+	kind := strings.ToLower(m.Kind)
+	if kind == "" {
+		kind = defaultKind
+	}
+	h, ok := messageHandlers[kind]
+	if !ok {
+		err := fmt.Errorf("Unsupported message kind %q", m.Kind)
+		glog.Errorf("Rejecting message %v", err)
+		rejectMessage(ctx, m, env.config, err)
+		return err
+	}
+	glog.Infof("Handling %s message %s", kind, m.URL)
+	if err := h.HandleMessage(ctx, m, env); err != nil {
+		glog.Errorf("Error handling %s message %v", kind, err)
+		return err
+	}
+	return nil
+}
+
+// rejectMessage reports the error on the task if the message references one
+func rejectMessage(ctx context.Context, m MQTTMessage, config *CatalogConfig, reason error) {
+	if m.URL == "" {
+		return
+	}
+	glog := logger.GetLogger(ctx)
+	tu := taskupdater.MakeTaskUpdater(ctx, m.URL, config.XRHIdentity)
+	errs := []*taskerror.Error{taskerror.New(taskerror.Validation, reason.Error())}
+	msg := map[string]interface{}{"messages": taskerror.Messages(errs), "errors": errs}
+	if _, err := tu.Do("completed", "error", &msg); err != nil {
+		glog.Errorf("Error updating task %s %v", m.URL, err)
+	}
+}
+
+// catalogHandler fetches the task and runs its jobs against Ansible Tower
+type catalogHandler struct{}
+
+func (ch *catalogHandler) HandleMessage(ctx context.Context, m MQTTMessage, env *MessageEnv) error {
+	runTask(ctx, m.URL, env.config, env.wh, env.shutdown, env.slots)
+	return nil
+}
+
+// cancelHandler cancels a queued or running task
+type cancelHandler struct{}
+
+func (ch *cancelHandler) HandleMessage(ctx context.Context, m MQTTMessage, env *MessageEnv) error {
+	return cancelTask(ctx, m.URL, env.config)
+}
+
+// pingHandler answers with a heartbeat so the controller can check the
+// client without waiting for the next one
+type pingHandler struct{}
+
+func (ph *pingHandler) HandleMessage(ctx context.Context, m MQTTMessage, env *MessageEnv) error {
+	msg := newStatusMessage(env.config, "online")
+	reachable := towerReachable(env.config)
+	msg.TowerReachable = &reachable
+	return publishJSON(env.client, heartbeatTopic(env.config), false, msg)
+}
+
+// configHandler changes the settings that can be updated at runtime
+type configHandler struct{}
+
+func (ch *configHandler) HandleMessage(ctx context.Context, m MQTTMessage, env *MessageEnv) error {
+	glog := logger.GetLogger(ctx)
+	// Every setting is validated before any of them is changed
+	var changes []func()
+	for key, value := range m.Params {
+		switch key {
+		case "debug":
+			debug, ok := value.(bool)
+			if !ok {
+				return fmt.Errorf("Invalid value %v for debug", value)
+			}
+			changes = append(changes, func() {
+				glog.Infof("Setting debug to %v", debug)
+				setLogLevel(debug)
+			})
+		default:
+			return fmt.Errorf("Unsupported configuration %q", key)
+		}
+	}
+	for _, change := range changes {
+		change()
+	}
+	return nil
+}
+
+func setLogLevel(debug bool) {
+	if debug {
+		log.SetLevel(log.DebugLevel)
+	} else {
+		log.SetLevel(log.WarnLevel)
+	}
+}
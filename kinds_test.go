@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestRouteDefaultKind(t *testing.T) {
+	log.SetOutput(os.Stdout)
+	ts, updates := fakeTaskServer(t, testPayload, "abc")
+	defer ts.Close()
+	fh := &FakeHandler{}
+	env := &MessageEnv{config: &CatalogConfig{XRHIdentity: "abc"}, wh: fh, shutdown: make(chan struct{})}
+	if err := routeMessage(testContext(), MQTTMessage{URL: ts.URL}, env); err != nil {
+		t.Fatalf("Error routing message %v", err)
+	}
+	if fh.timesCalled != 2 {
+		t.Fatalf("2 workers should have been started only %d were started", fh.timesCalled)
+	}
+	if len(*updates) != 1 {
+		t.Fatalf("Task should have been updated once, got %d updates", len(*updates))
+	}
+}
+
+func TestRouteUnknownKind(t *testing.T) {
+	log.SetOutput(os.Stdout)
+	ts, updates := fakeTaskServer(t, testPayload, "abc")
+	defer ts.Close()
+	fh := &FakeHandler{}
+	env := &MessageEnv{config: &CatalogConfig{XRHIdentity: "abc"}, wh: fh, shutdown: make(chan struct{})}
+	if err := routeMessage(testContext(), MQTTMessage{URL: ts.URL, Kind: "Charkie"}, env); err == nil {
+		t.Fatalf("Unknown kind should have been rejected")
+	}
+	if fh.timesCalled != 0 {
+		t.Fatalf("No workers should have been started")
+	}
+	if len(*updates) != 1 || (*updates)[0] != "completed" {
+		t.Fatalf("Task should have been updated with the error, got %v", *updates)
+	}
+}
+
+func TestConfigKind(t *testing.T) {
+	log.SetOutput(os.Stdout)
+	defer log.SetLevel(log.GetLevel())
+	env := &MessageEnv{config: &CatalogConfig{}}
+	m := MQTTMessage{Kind: "config", Params: map[string]interface{}{"debug": true}}
+	if err := routeMessage(testContext(), m, env); err != nil {
+		t.Fatalf("Error routing message %v", err)
+	}
+	if log.GetLevel() != log.DebugLevel {
+		t.Fatalf("Debug logging should have been enabled")
+	}
+
+	m.Params = map[string]interface{}{"verbose": true}
+	if err := routeMessage(testContext(), m, env); err == nil {
+		t.Fatalf("Unsupported configuration should have been rejected")
+	}
+
+	m.Params = map[string]interface{}{"debug": false, "verbose": true}
+	if err := routeMessage(testContext(), m, env); err == nil {
+		t.Fatalf("Unsupported configuration should have been rejected")
+	}
+	if log.GetLevel() != log.DebugLevel {
+		t.Fatalf("Nothing should be changed when a setting is rejected")
+	}
+}
+
+func TestPingKind(t *testing.T) {
+	log.SetOutput(os.Stdout)
+	broker := startFakeBroker(t)
+	defer broker.close()
+	config := testMQTTConfig(broker)
+	uri, _ := url.Parse(config.MQTTURL)
+	client, err := connect("tower_client_123", uri, config)
+	if err != nil {
+		t.Fatalf("Error connecting to broker %v", err)
+	}
+	defer client.Disconnect(10)
+
+	env := &MessageEnv{client: client, config: config}
+	if err := routeMessage(testContext(), MQTTMessage{Kind: "ping"}, env); err != nil {
+		t.Fatalf("Error routing message %v", err)
+	}
+	p := broker.waitForMessage("in/123/heartbeat")
+	if decodeStatus(t, p.Payload).GUID != "123" {
+		t.Fatalf("Expected a heartbeat got %s", string(p.Payload))
+	}
+}
+
+func TestRegisterDuplicateKind(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("Registering a kind twice should panic")
+		}
+	}()
+	RegisterMessageHandler("Ping", &pingHandler{})
+}
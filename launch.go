@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mkanoor/catalog_mqtt_client/internal/taskerror"
+	"gopkg.in/yaml.v2"
+)
+
+// LaunchError lists what is missing from the params to launch a template
+type LaunchError struct {
+	Template         string   `json:"template"`
+	MissingVariables []string `json:"missing_variables,omitempty"`
+	MissingPasswords []string `json:"missing_passwords,omitempty"`
+	MissingFields    []string `json:"missing_fields,omitempty"`
+	NotPrompted      []string `json:"not_prompted,omitempty"`
+}
+
+func (e *LaunchError) Error() string {
+	b, _ := json.Marshal(e)
+	return "Launch validation failed " + string(b)
+}
+
+func (e *LaunchError) empty() bool {
+	return len(e.MissingVariables) == 0 && len(e.MissingPasswords) == 0 &&
+		len(e.MissingFields) == 0 && len(e.NotPrompted) == 0
+}
+
+// launchInfo has the attributes of the launch endpoint of a template we
+// check before launching it
+type launchInfo struct {
+	VariablesNeededToStart  []string        `json:"variables_needed_to_start"`
+	PasswordsNeededToStart  []string        `json:"passwords_needed_to_start"`
+	CredentialNeededToStart bool            `json:"credential_needed_to_start"`
+	InventoryNeededToStart  bool            `json:"inventory_needed_to_start"`
+	SurveyEnabled           bool            `json:"survey_enabled"`
+	Ask                     map[string]bool `json:"-"`
+}
+
+// promptedParams maps the params of a launch to the ask_*_on_launch
+// attribute that allows them
+var promptedParams = map[string]string{
+	"extra_vars":  "ask_variables_on_launch",
+	"inventory":   "ask_inventory_on_launch",
+	"credential":  "ask_credential_on_launch",
+	"credentials": "ask_credential_on_launch",
+	"limit":       "ask_limit_on_launch",
+	"job_tags":    "ask_tags_on_launch",
+	"skip_tags":   "ask_skip_tags_on_launch",
+	"job_type":    "ask_job_type_on_launch",
+	"verbosity":   "ask_verbosity_on_launch",
+	"diff_mode":   "ask_diff_mode_on_launch",
+	"scm_branch":  "ask_scm_branch_on_launch",
+}
+
+// checkLaunch gets the launch endpoint of the template and fails before
+// the launch if the params don't have everything the template needs
+func (w *WorkUnit) checkLaunch() error {
+	body, _, err := w.fetchURL(w.parsedURL)
+	if err != nil {
+		return err
+	}
+	info, err := parseLaunchInfo(body)
+	if err != nil {
+		w.sendError(taskerror.Data, err.Error())
+		w.glog.Errorf("Error %v", err)
+		return err
+	}
+	lerr := info.validate(w.input.HrefSlug, w.input.Params)
+	if lerr != nil {
+		w.reportError(&taskerror.Error{Category: taskerror.Validation, Message: "Launch validation failed", Body: lerr})
+		w.glog.Errorf("%v", lerr)
+		return lerr
+	}
+	return nil
+}
+
+func parseLaunchInfo(body []byte) (*launchInfo, error) {
+	info := &launchInfo{}
+	if err := json.Unmarshal(body, info); err != nil {
+		return nil, err
+	}
+	var all map[string]interface{}
+	if err := json.Unmarshal(body, &all); err != nil {
+		return nil, err
+	}
+	info.Ask = make(map[string]bool)
+	for k, v := range all {
+		if b, ok := v.(bool); ok && strings.HasPrefix(k, "ask_") && strings.HasSuffix(k, "_on_launch") {
+			info.Ask[k] = b
+		}
+	}
+	return info, nil
+}
+
+// validate compares the launch requirements with the params, it returns
+// nil when the template can be launched
+func (info *launchInfo) validate(template string, params map[string]interface{}) *LaunchError {
+	lerr := &LaunchError{Template: template}
+
+	vars, err := extraVars(params["extra_vars"])
+	if err != nil {
+		lerr.MissingFields = append(lerr.MissingFields, "extra_vars")
+	}
+	for _, v := range info.VariablesNeededToStart {
+		if _, ok := vars[v]; !ok {
+			lerr.MissingVariables = append(lerr.MissingVariables, v)
+		}
+	}
+
+	passwords, _ := params["credential_passwords"].(map[string]interface{})
+	for _, p := range info.PasswordsNeededToStart {
+		if !hasParam(params, p) && !hasParam(passwords, p) {
+			lerr.MissingPasswords = append(lerr.MissingPasswords, p)
+		}
+	}
+
+	if info.CredentialNeededToStart && !hasParam(params, "credential") && !hasParam(params, "credentials") {
+		lerr.MissingFields = append(lerr.MissingFields, "credentials")
+	}
+	if info.InventoryNeededToStart && !hasParam(params, "inventory") {
+		lerr.MissingFields = append(lerr.MissingFields, "inventory")
+	}
+
+	for k := range params {
+		ask, ok := promptedParams[k]
+		if !ok {
+			continue
+		}
+		// Survey answers are passed in the extra vars
+		if k == "extra_vars" && info.SurveyEnabled {
+			continue
+		}
+		if allowed, ok := info.Ask[ask]; ok && !allowed {
+			lerr.NotPrompted = append(lerr.NotPrompted, k)
+		}
+	}
+	sort.Strings(lerr.NotPrompted)
+
+	if lerr.empty() {
+		return nil
+	}
+	return lerr
+}
+
+// extraVars parses the extra vars which can be an object or a JSON or
+// YAML string
+func extraVars(v interface{}) (map[string]interface{}, error) {
+	switch vars := v.(type) {
+	case nil:
+		return nil, nil
+	case map[string]interface{}:
+		return vars, nil
+	case string:
+		result := make(map[string]interface{})
+		if err := yaml.Unmarshal([]byte(vars), &result); err != nil {
+			return nil, err
+		}
+		return result, nil
+	default:
+		return nil, fmt.Errorf("Invalid extra_vars %v", v)
+	}
+}
+
+// hasParam checks if the param is set to a non empty value
+func hasParam(params map[string]interface{}, key string) bool {
+	v, ok := params[key]
+	if !ok || v == nil {
+		return false
+	}
+	switch value := v.(type) {
+	case string:
+		return value != ""
+	case []interface{}:
+		return len(value) > 0
+	}
+	return true
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
-	"flag"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/url"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
@@ -22,37 +25,135 @@ type CatalogConfig struct {
 	SkipVerifyCertificate bool   // Skip Certifcate Validation
 	MQTTURL               string // The URL for MQTT Server
 	GUID                  string // The Client GUID
+	XRHIdentity           string // The identity header used with the task service
+	UploadUser            string // The user for the upload service
+	UploadPassword        string // The password for the upload service
+	MQTTCACert            string // The CA bundle used to verify the MQTT Server
+	MQTTClientCert        string // The client certificate presented to the MQTT Server
+	MQTTClientKey         string // The private key for the client certificate
+	MQTTServerName        string // Override the server name used to verify the MQTT Server
+
+	MQTTReconnect            bool          // Reconnect when the connection to the MQTT Server is lost
+	MQTTReconnectMinInterval time.Duration // The initial delay between reconnect attempts
+	MQTTReconnectMaxInterval time.Duration // The maximum delay between reconnect attempts
+
+	StatusTopic       string        // The topic for online/offline status, %s is replaced by the GUID
+	HeartbeatTopic    string        // The topic for heartbeats, %s is replaced by the GUID
+	HeartbeatInterval time.Duration // The interval between heartbeats, 0 disables them
+
+	MaxConcurrentTasks int // The number of tasks processed at the same time, 0 is unlimited
+	MaxWorkersPerTask  int // The number of workers running at the same time in a task, 0 is unlimited
+
+	TaskTimeout time.Duration // The time a task can take, 0 is unlimited, the task payload can override it
+
+	RetryMaxAttempts int           // The number of attempts for a Tower call, 1 disables retries
+	RetryMinInterval time.Duration // The initial delay between attempts
+	RetryMaxInterval time.Duration // The maximum delay between attempts
+	RetryStatusCodes StatusCodes   // The HTTP status codes that are retried
+
+	TowerRequestsPerSecond float64 // The rate of requests to Tower, 0 is unlimited
+	TowerBurst             int     // The number of requests that can be sent at once
+	SyncStateFile          string  // The file storing the time and the ids of the last collections
 }
 
 func main() {
 	startRun(os.Stdin, &DefaultRequestHandler{})
 }
 
-func connect(clientId string, uri *url.URL) (mqtt.Client, error) {
-	opts := createClientOptions(clientId, uri)
-	client := mqtt.NewClient(opts)
-	token := client.Connect()
+// brokerSchemes maps the schemes allowed in the MQTT URL to the
+// schemes understood by the paho client
+var brokerSchemes = map[string]string{
+	"":      "tcp",
+	"mqtt":  "tcp",
+	"tcp":   "tcp",
+	"mqtts": "ssl",
+	"ssl":   "ssl",
+	"tls":   "ssl",
+	"ws":    "ws",
+	"wss":   "wss",
+}
+
+func connect(clientId string, uri *url.URL, config *CatalogConfig) (mqtt.Client, error) {
+	opts, err := createClientOptions(clientId, uri, config)
+	if err != nil {
+		return nil, err
+	}
+	rc := newReconnectingClient(config)
+	opts.SetAutoReconnect(false)
+	opts.SetOnConnectHandler(rc.onConnect)
+	opts.SetConnectionLostHandler(rc.onConnectionLost)
+	rc.Client = mqtt.NewClient(opts)
+	token := rc.Client.Connect()
 	for !token.WaitTimeout(3 * time.Second) {
 	}
 	if err := token.Error(); err != nil {
+		if opts.TLSConfig != nil {
+			return nil, fmt.Errorf("TLS connection to %s failed, check the CA bundle, client certificate and server name: %v", uri.Host, err)
+		}
 		return nil, err
 	}
-	return client, nil
+	return rc, nil
 }
 
-func createClientOptions(clientId string, uri *url.URL) *mqtt.ClientOptions {
+func createClientOptions(clientId string, uri *url.URL, config *CatalogConfig) (*mqtt.ClientOptions, error) {
+	scheme, ok := brokerSchemes[strings.ToLower(uri.Scheme)]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported MQTT URL scheme %s", uri.Scheme)
+	}
 	opts := mqtt.NewClientOptions()
-	opts.AddBroker(fmt.Sprintf("tcp://%s", uri.Host))
+	broker := url.URL{Scheme: scheme, Host: uri.Host}
+	if scheme == "ws" || scheme == "wss" {
+		broker.Path = uri.Path
+	}
+	opts.AddBroker(broker.String())
 	opts.SetUsername(uri.User.Username())
 	password, _ := uri.User.Password()
 	opts.SetPassword(password)
 	opts.SetClientID(clientId)
-	return opts
+	opts.SetWill(statusTopic(config), offlinePayload(config), 1, true)
+
+	if scheme == "ssl" || scheme == "wss" {
+		tlsConfig, err := createTLSConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+	return opts, nil
+}
+
+// createTLSConfig builds the TLS configuration for the MQTT connection. If no
+// CA bundle is given the system roots are used.
+func createTLSConfig(config *CatalogConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{ServerName: config.MQTTServerName}
+
+	if config.MQTTCACert != "" {
+		b, err := ioutil.ReadFile(config.MQTTCACert)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading MQTT CA bundle %s: %v", config.MQTTCACert, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("No certificates found in MQTT CA bundle %s", config.MQTTCACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.MQTTClientCert != "" || config.MQTTClientKey != "" {
+		if config.MQTTClientCert == "" || config.MQTTClientKey == "" {
+			return nil, fmt.Errorf("Both mqtt_client_cert and mqtt_client_key are needed for a client certificate")
+		}
+		cert, err := tls.LoadX509KeyPair(config.MQTTClientCert, config.MQTTClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading MQTT client certificate %s: %v", config.MQTTClientCert, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
 }
 
 func startRun(reader io.Reader, rh RequestHandler) {
 
-	config := CatalogConfig{}
 	logFileName := "/tmp/catalog_mqtt_client" + strconv.Itoa(os.Getpid()) + ".log"
 	logf, err := os.OpenFile(logFileName, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0666)
 	if err != nil {
@@ -61,18 +162,12 @@ func startRun(reader io.Reader, rh RequestHandler) {
 	defer logf.Close()
 	defer log.Info("Finished Catalog Worker")
 
-	if true {
-		config.Debug = true
-		config.URL = "https://18.188.178.206"
-		config.Token = "YtzduqUqpzi41nGth1IuZryLM3CjbB"
-		config.SkipVerifyCertificate = true
-		config.MQTTURL = "mqtt://localhost:1883"
-		config.GUID = "123456789"
-	} else {
-		setConfig(&config)
+	config, err := loadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatalf("Error loading configuration: %v", err)
 	}
 
-	configLogger(&config, logf)
+	configLogger(config, logf)
 	log.Infof("Config Debug: %v", config.Debug)
 	log.Infof("Config URL: %v", config.URL)
 	log.Infof("Config Token: %v", config.Token)
@@ -87,40 +182,26 @@ func startRun(reader io.Reader, rh RequestHandler) {
 		return
 	}
 
-	mqttClient, err := connect("tower_client_"+config.GUID, uri)
+	mqttClient, err := connect("tower_client_"+config.GUID, uri, config)
 	if err != nil {
 		log.Errorf("Error connecting to MQTT Server %v", err)
 		return
 	}
 
-	log.Infof("Connected to MQTT Server %s", config.MQTTURL)
-	rh.startHandlingRequests(mqttClient, &config, &DefaultAPIWorker{})
-}
-
-func setConfig(config *CatalogConfig) {
-	flag.StringVar(&config.Token, "token", "", "Ansible Tower token")
-	flag.StringVar(&config.URL, "url", "", "Ansible Tower URL")
-	flag.BoolVar(&config.Debug, "debug", false, "log debug messages")
-	flag.BoolVar(&config.SkipVerifyCertificate, "skip_verify_ssl", false, "skip tower certificate verification")
-	flag.StringVar(&config.MQTTURL, "mqtturl", "", "MQTTURL")
-	flag.StringVar(&config.GUID, "guid", "", "Client GUID")
-
-	flag.Parse()
-
-	if config.Token == "" || config.URL == "" || config.GUID == "" {
-		log.Fatal("Token, GUID and URL parameters are required")
+	aw, err := MakeDefaultAPIWorker(config)
+	if err != nil {
+		log.Errorf("Error creating worker %v", err)
+		return
 	}
 
+	log.Infof("Connected to MQTT Server %s", config.MQTTURL)
+	rh.startHandlingRequests(mqttClient, config, aw)
 }
 
 // Configure the logger
 func configLogger(config *CatalogConfig, f *os.File) {
 	log.SetFormatter(&log.JSONFormatter{})
 	log.SetOutput(f)
-	if config.Debug {
-		log.SetLevel(log.DebugLevel)
-	} else {
-		log.SetLevel(log.WarnLevel)
-	}
+	setLogLevel(config.Debug)
 	log.SetReportCaller(true)
 }
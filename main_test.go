@@ -1,52 +1,110 @@
 package main
 
 import (
-	"bytes"
-	"io"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
-type FakeRequestHandler struct {
-	timesCalled   int
-	catalogConfig CatalogConfig
+// writeTestCertificate creates a self signed certificate and key in dir
+func writeTestCertificate(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key %v", err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "catalog client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Error creating certificate %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Error marshaling key %v", err)
+	}
+	certFile := filepath.Join(dir, "client.crt")
+	keyFile := filepath.Join(dir, "client.key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile
 }
 
-func (frh *FakeRequestHandler) getRequest(r io.Reader) ([]byte, error) {
-	var s []byte
-	frh.timesCalled++
-	return s, nil
-}
+func TestCreateClientOptionsSchemes(t *testing.T) {
+	tests := map[string]string{
+		"mqtt://localhost:1883":    "tcp://localhost:1883",
+		"tcp://localhost:1883":     "tcp://localhost:1883",
+		"mqtts://localhost:8883":   "ssl://localhost:8883",
+		"ssl://localhost:8883":     "ssl://localhost:8883",
+		"wss://localhost:443/mqtt": "wss://localhost:443/mqtt",
+	}
+	for input, broker := range tests {
+		uri, _ := url.Parse(input)
+		opts, err := createClientOptions("id", uri, &CatalogConfig{})
+		if err != nil {
+			t.Fatalf("Error creating options for %s %v", input, err)
+		}
+		if opts.Servers[0].String() != broker {
+			t.Errorf("Expected broker %s got %s", broker, opts.Servers[0].String())
+		}
+		if (opts.TLSConfig != nil) != (strings.HasPrefix(broker, "ssl") || strings.HasPrefix(broker, "wss")) {
+			t.Errorf("TLS config not set correctly for %s", input)
+		}
+	}
 
-func (frh *FakeRequestHandler) parseRequest(b []byte) (*RequestMessage, error) {
-	frh.timesCalled++
-	return &RequestMessage{}, nil
+	uri, _ := url.Parse("http://localhost")
+	if _, err := createClientOptions("id", uri, &CatalogConfig{}); err == nil {
+		t.Errorf("Unsupported scheme should fail")
+	}
 }
 
-func (frh *FakeRequestHandler) processRequest(req *RequestMessage, config CatalogConfig, wh WorkHandler) {
-	frh.timesCalled++
-	frh.catalogConfig = config
+func TestCreateTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catalog_tls")
+	if err != nil {
+		t.Fatalf("Error creating temp directory %v", err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestCertificate(t, dir)
+
+	config := &CatalogConfig{MQTTCACert: certFile, MQTTClientCert: certFile, MQTTClientKey: keyFile, MQTTServerName: "broker.example.com"}
+	tlsConfig, err := createTLSConfig(config)
+	if err != nil {
+		t.Fatalf("Error creating TLS config %v", err)
+	}
+	if tlsConfig.RootCAs == nil || len(tlsConfig.Certificates) != 1 || tlsConfig.ServerName != "broker.example.com" {
+		t.Errorf("TLS config not populated %v", tlsConfig)
+	}
+
+	if _, err = createTLSConfig(&CatalogConfig{MQTTClientCert: certFile}); err == nil {
+		t.Errorf("Client certificate without key should fail")
+	}
+	if _, err = createTLSConfig(&CatalogConfig{MQTTCACert: keyFile}); err == nil {
+		t.Errorf("CA bundle without certificates should fail")
+	}
 }
 
-func TestMain(t *testing.T) {
-	os.Args = []string{"catalog_worker",
-		"--debug",
-		"--token", "gobbledygook",
-		"--url", "https://www.example.com"}
-	b := []byte(`{"account":"12345","sender":"buzz", "message_id":"4567","payload":{"jobs": [{"method":"monitor","href_slug":"/api/v2/jobs/7008","accept_encoding":"gzip"}]}}`)
-	bo := bytes.NewBuffer(b)
-	frh := &FakeRequestHandler{}
-	startRun(bo, frh)
-	if frh.timesCalled != 3 {
-		t.Errorf("Request handler not called 3 times")
-	}
-	if !frh.catalogConfig.Debug {
-		t.Errorf("Debug is not being enabled")
-	}
-	if frh.catalogConfig.URL != "https://www.example.com" {
-		t.Errorf("Debug is not being enabled")
-	}
-	if frh.catalogConfig.Token != "gobbledygook" {
-		t.Errorf("Token has not been set")
+func TestConnectTLSHandshakeFailure(t *testing.T) {
+	ts := httptest.NewTLSServer(nil)
+	defer ts.Close()
+	uri, _ := url.Parse(strings.Replace(ts.URL, "https", "mqtts", 1))
+	_, err := connect("id", uri, &CatalogConfig{})
+	if err == nil || !strings.Contains(err.Error(), "TLS connection") {
+		t.Fatalf("Expected TLS connection error got %v", err)
 	}
 }
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/mkanoor/catalog_mqtt_client/internal/backoff"
+	log "github.com/sirupsen/logrus"
+)
+
+// reconnectingClient wraps the paho client, when the connection to the
+// MQTT Server is lost it reconnects with an exponential backoff and restores
+// all the topic subscriptions
+type reconnectingClient struct {
+	mqtt.Client
+	config  *CatalogConfig
+	mu      sync.Mutex
+	topics  map[string]byte
+	stopped chan struct{}
+	once    sync.Once
+}
+
+func newReconnectingClient(config *CatalogConfig) *reconnectingClient {
+	return &reconnectingClient{
+		config:  config,
+		topics:  make(map[string]byte),
+		stopped: make(chan struct{}),
+	}
+}
+
+// Subscribe to a topic and remember it so it can be restored on reconnect
+func (rc *reconnectingClient) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	rc.mu.Lock()
+	rc.topics[topic] = qos
+	rc.mu.Unlock()
+	return rc.Client.Subscribe(topic, qos, callback)
+}
+
+// Disconnect from the MQTT Server and stop any pending reconnects
+func (rc *reconnectingClient) Disconnect(quiesce uint) {
+	rc.once.Do(func() { close(rc.stopped) })
+	rc.Client.Disconnect(quiesce)
+}
+
+// onConnect restores the subscriptions, the message handlers are still
+// registered with the paho router so they don't have to be passed again
+func (rc *reconnectingClient) onConnect(client mqtt.Client) {
+	log.Infof("Connection to MQTT Server %s established", rc.config.MQTTURL)
+	publishStatus(client, rc.config, "online")
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	for topic, qos := range rc.topics {
+		log.Infof("Resubscribing to topic %s", topic)
+		if token := client.Subscribe(topic, qos, nil); token.Wait() && token.Error() != nil {
+			log.Errorf("Error resubscribing to topic %s %v", topic, token.Error())
+		}
+	}
+}
+
+func (rc *reconnectingClient) onConnectionLost(client mqtt.Client, err error) {
+	log.Errorf("Connection to MQTT Server %s lost %v", rc.config.MQTTURL, err)
+	if rc.config.MQTTReconnect {
+		go rc.reconnect()
+	}
+}
+
+func (rc *reconnectingClient) reconnect() {
+	b := backoff.Backoff{Min: rc.config.MQTTReconnectMinInterval, Max: rc.config.MQTTReconnectMaxInterval}
+	for {
+		delay := b.Next()
+		log.Infof("Reconnecting to MQTT Server in %v, attempt %d", delay, b.Attempts())
+		select {
+		case <-rc.stopped:
+			log.Info("Client is disconnecting, reconnect abandoned")
+			return
+		case <-time.After(delay):
+		}
+
+		token := rc.Client.Connect()
+		token.Wait()
+		if token.Error() == nil {
+			log.Infof("Reconnected to MQTT Server %s after %d attempts", rc.config.MQTTURL, b.Attempts())
+			return
+		}
+		log.Errorf("Reconnect to MQTT Server failed %v", token.Error())
+	}
+}
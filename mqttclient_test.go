@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func testMQTTConfig(broker *fakeBroker) *CatalogConfig {
+	return &CatalogConfig{
+		MQTTURL:                  broker.url(),
+		GUID:                     "123",
+		XRHIdentity:              "abc",
+		MQTTReconnect:            true,
+		MQTTReconnectMinInterval: 10 * time.Millisecond,
+		MQTTReconnectMaxInterval: 50 * time.Millisecond,
+		StatusTopic:              "in/%s/status",
+		HeartbeatTopic:           "in/%s/heartbeat",
+	}
+}
+
+func TestReconnectAfterBrokerBounce(t *testing.T) {
+	log.SetOutput(os.Stdout)
+	broker := startFakeBroker(t)
+	defer broker.close()
+	task, _ := fakeTaskServer(t, testPayload, "abc")
+	defer task.Close()
+
+	config := testMQTTConfig(broker)
+	uri, _ := url.Parse(config.MQTTURL)
+	client, err := connect("tower_client_123", uri, config)
+	if err != nil {
+		t.Fatalf("Error connecting to broker %v", err)
+	}
+	defer client.Disconnect(10)
+
+	fh := &FakeHandler{}
+	startMQTTListener(client, config, fh, make(chan struct{}))
+	broker.waitForSubscription("out/123")
+
+	msg, _ := json.Marshal(MQTTMessage{URL: task.URL, Kind: "catalog"})
+	broker.publish("out/123", msg)
+	waitForCalls(t, fh, 2)
+
+	broker.bounce()
+	broker.waitForSubscription("out/123")
+
+	broker.publish("out/123", msg)
+	waitForCalls(t, fh, 4)
+}
+
+func TestReconnectStopsOnDisconnect(t *testing.T) {
+	log.SetOutput(os.Stdout)
+	broker := startFakeBroker(t)
+	defer broker.close()
+	config := testMQTTConfig(broker)
+	config.MQTTReconnectMinInterval = 100 * time.Millisecond
+	uri, _ := url.Parse(config.MQTTURL)
+	client, err := connect("tower_client_123", uri, config)
+	if err != nil {
+		t.Fatalf("Error connecting to broker %v", err)
+	}
+	broker.bounce()
+	client.Disconnect(10)
+	time.Sleep(300 * time.Millisecond)
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	if broker.connects != 1 {
+		t.Fatalf("Client should not reconnect after Disconnect, connected %d times", broker.connects)
+	}
+}
+
+func waitForCalls(t *testing.T, fh *FakeHandler, count int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		fh.mu.Lock()
+		called := fh.timesCalled
+		fh.mu.Unlock()
+		if called >= count {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Work handler was not called %d times", count)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mkanoor/catalog_mqtt_client/internal/taskerror"
+)
+
+// jobOutcomes records the pages, the duration and the errors of every job
+// of a task, the jobs are numbered from 1 as they are dispatched
+type jobOutcomes struct {
+	mu      sync.Mutex
+	jobs    []*taskerror.Outcome
+	started []time.Time
+}
+
+func newJobOutcomes() *jobOutcomes {
+	return &jobOutcomes{}
+}
+
+// add numbers the job so its pages and errors can be matched to it
+func (o *jobOutcomes) add(j *JobParam) {
+	if o == nil {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.jobs = append(o.jobs, &taskerror.Outcome{HrefSlug: j.HrefSlug, Method: j.Method, Status: taskerror.StatusIncomplete})
+	o.started = append(o.started, time.Time{})
+	j.id = len(o.jobs)
+}
+
+// get returns the outcome of the job, the lock has to be held
+func (o *jobOutcomes) get(id int) *taskerror.Outcome {
+	if id < 1 || id > len(o.jobs) {
+		return nil
+	}
+	return o.jobs[id-1]
+}
+
+// start records when a worker picked up the job
+func (o *jobOutcomes) start(id int) {
+	if o == nil {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.get(id) != nil {
+		o.started[id-1] = time.Now()
+	}
+}
+
+func (o *jobOutcomes) page(id int) {
+	if o == nil {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if out := o.get(id); out != nil {
+		out.Pages++
+	}
+}
+
+func (o *jobOutcomes) finish(id int) {
+	if o == nil {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	out := o.get(id)
+	if out == nil {
+		return
+	}
+	out.DurationSeconds = time.Since(o.started[id-1]).Seconds()
+	out.Status = taskerror.StatusOK
+	if len(out.Errors) > 0 {
+		out.Status = taskerror.StatusError
+	}
+}
+
+func (o *jobOutcomes) addError(e *taskerror.Error) {
+	if o == nil {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if out := o.get(e.JobID); out != nil {
+		out.Errors = append(out.Errors, e)
+		out.Status = taskerror.StatusError
+	}
+}
+
+// list returns a copy of the outcomes
+func (o *jobOutcomes) list() []*taskerror.Outcome {
+	if o == nil {
+		return nil
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	jobs := make([]*taskerror.Outcome, len(o.jobs))
+	for i, out := range o.jobs {
+		c := *out
+		jobs[i] = &c
+	}
+	return jobs
+}
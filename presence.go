@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+)
+
+// Version of the client, set at build time
+var Version = "dev"
+
+var startTime = time.Now()
+
+// StatusMessage is published on the status and heartbeat topics so the
+// cloud controller knows if the client is alive
+type StatusMessage struct {
+	GUID           string `json:"guid"`
+	State          string `json:"state"`
+	Version        string `json:"version"`
+	UptimeSeconds  int64  `json:"uptime_seconds"`
+	TowerReachable *bool  `json:"tower_reachable,omitempty"`
+	InFlightTasks  int32  `json:"in_flight_tasks"`
+	QueuedTasks    int32  `json:"queued_tasks"`
+	Sent           string `json:"sent"`
+}
+
+// The topics can contain a %s which gets replaced with the client GUID
+func statusTopic(config *CatalogConfig) string {
+	return strings.Replace(config.StatusTopic, "%s", config.GUID, -1)
+}
+
+func heartbeatTopic(config *CatalogConfig) string {
+	return strings.Replace(config.HeartbeatTopic, "%s", config.GUID, -1)
+}
+
+func newStatusMessage(config *CatalogConfig, state string) StatusMessage {
+	return StatusMessage{
+		GUID:          config.GUID,
+		State:         state,
+		Version:       Version,
+		UptimeSeconds: int64(time.Since(startTime).Seconds()),
+		InFlightTasks: atomic.LoadInt32(&inFlightTasks),
+		QueuedTasks:   atomic.LoadInt32(&queuedTasks),
+		Sent:          time.Now().UTC().Format(time.RFC3339),
+	}
+}
+
+// offlinePayload is registered as the Last Will so the MQTT Server
+// publishes it when the client goes away without saying goodbye
+func offlinePayload(config *CatalogConfig) string {
+	b, _ := json.Marshal(newStatusMessage(config, "offline"))
+	return string(b)
+}
+
+// publishStatus publishes a retained online/offline message on the status topic
+func publishStatus(client mqtt.Client, config *CatalogConfig, state string) error {
+	return publishJSON(client, statusTopic(config), true, newStatusMessage(config, state))
+}
+
+func publishJSON(client mqtt.Client, topic string, retained bool, data interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		log.Errorf("Error marshaling message for topic %s %v", topic, err)
+		return err
+	}
+	token := client.Publish(topic, 1, retained, b)
+	if !token.WaitTimeout(10*time.Second) || token.Error() != nil {
+		log.Errorf("Error publishing to topic %s %v", topic, token.Error())
+		return token.Error()
+	}
+	return nil
+}
+
+// startHeartbeat publishes the client status periodically till shutdown
+func startHeartbeat(client mqtt.Client, config *CatalogConfig, shutdown chan struct{}) {
+	if config.HeartbeatInterval <= 0 {
+		log.Info("Heartbeat disabled")
+		return
+	}
+	ticker := time.NewTicker(config.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if !client.IsConnected() {
+				continue
+			}
+			msg := newStatusMessage(config, "online")
+			reachable := towerReachable(config)
+			msg.TowerReachable = &reachable
+			publishJSON(client, heartbeatTopic(config), false, msg)
+		case <-shutdown:
+			return
+		}
+	}
+}
+
+// towerReachable pings the Ansible Tower
+func towerReachable(config *CatalogConfig) bool {
+	client := towerClient(config)
+	client.Timeout = 10 * time.Second
+	req, err := http.NewRequest("GET", strings.TrimSuffix(config.URL, "/")+"/api/v2/ping/", nil)
+	if err != nil {
+		log.Errorf("Error creating ping request %v", err)
+		return false
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Errorf("Error pinging Ansible Tower %v", err)
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func decodeStatus(t *testing.T, b []byte) StatusMessage {
+	var msg StatusMessage
+	if err := json.Unmarshal(b, &msg); err != nil {
+		t.Fatalf("Error decoding status message %v", err)
+	}
+	return msg
+}
+
+func TestPresence(t *testing.T) {
+	log.SetOutput(os.Stdout)
+	broker := startFakeBroker(t)
+	defer broker.close()
+	config := testMQTTConfig(broker)
+	uri, _ := url.Parse(config.MQTTURL)
+	client, err := connect("tower_client_123", uri, config)
+	if err != nil {
+		t.Fatalf("Error connecting to broker %v", err)
+	}
+	defer client.Disconnect(10)
+
+	p := broker.waitForMessage("in/123/status")
+	if !p.Retain || decodeStatus(t, p.Payload).State != "online" {
+		t.Errorf("Expected retained online status got %s", string(p.Payload))
+	}
+
+	broker.mu.Lock()
+	will, ok := broker.wills["in/123/status"]
+	broker.mu.Unlock()
+	if !ok || decodeStatus(t, will).State != "offline" {
+		t.Errorf("Expected offline last will got %s", string(will))
+	}
+
+	publishStatus(client, config, "offline")
+	p = broker.waitForMessage("in/123/status")
+	if decodeStatus(t, p.Payload).State != "offline" {
+		t.Errorf("Expected offline status got %s", string(p.Payload))
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	log.SetOutput(os.Stdout)
+	tower := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v2/ping/" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer tower.Close()
+	broker := startFakeBroker(t)
+	defer broker.close()
+	config := testMQTTConfig(broker)
+	config.URL = tower.URL
+	config.HeartbeatInterval = 20 * time.Millisecond
+	uri, _ := url.Parse(config.MQTTURL)
+	client, err := connect("tower_client_123", uri, config)
+	if err != nil {
+		t.Fatalf("Error connecting to broker %v", err)
+	}
+	defer client.Disconnect(10)
+
+	shutdown := make(chan struct{})
+	done := make(chan bool)
+	go func() {
+		startHeartbeat(client, config, shutdown)
+		done <- true
+	}()
+
+	msg := decodeStatus(t, broker.waitForMessage("in/123/heartbeat").Payload)
+	close(shutdown)
+	<-done
+	if msg.TowerReachable == nil || !*msg.TowerReachable {
+		t.Errorf("Tower should be reachable")
+	}
+	if msg.Version != Version || msg.GUID != "123" {
+		t.Errorf("Invalid heartbeat %v", msg)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/mkanoor/catalog_mqtt_client/internal/logger"
+	"github.com/mkanoor/catalog_mqtt_client/internal/taskupdater"
+)
+
+// defaultStreamMaxBytes limits the output sent in a single progress update
+const defaultStreamMaxBytes = 64 * 1024
+
+// redacted replaces the sensitive values found in the output
+const redacted = "********"
+
+// secretPattern matches the common ways passwords and tokens show up in
+// playbook output, the value is redacted and the key is kept
+var secretPattern = regexp.MustCompile(`(?i)((?:password|passwd|secret|token|api_key)["']?\s*[:=]\s*["']?)[^\s"',}]+`)
+
+// Progress is pushed to the cloud while a job is being monitored
+type Progress struct {
+	HrefSlug  string                   `json:"href_slug"`
+	Events    []map[string]interface{} `json:"events,omitempty"`
+	Stdout    string                   `json:"stdout,omitempty"`
+	Truncated bool                     `json:"truncated,omitempty"`
+	Approvals []PendingApproval        `json:"approvals,omitempty"`
+}
+
+// eventAttributes are the job event attributes sent to the cloud
+var eventAttributes = []string{"counter", "event", "event_display", "created", "task", "host_name", "failed", "changed", "stdout"}
+
+// outputStream keeps track of the output already sent for a monitored job
+type outputStream struct {
+	kind        string
+	maxBytes    int
+	redact      []*regexp.Regexp
+	lastCounter int64
+	offset      int
+	pending     string // redacted stdout not sent yet
+	complete    bool   // the stdout of the finished job has been read
+}
+
+// newOutputStream validates the stream options of the job
+func (w *WorkUnit) newOutputStream() (*outputStream, error) {
+	kind := strings.ToLower(w.input.StreamOutput)
+	if kind == "" {
+		return nil, nil
+	}
+	if kind != "events" && kind != "stdout" {
+		return nil, fmt.Errorf("Invalid stream_output %s, it should be events or stdout", w.input.StreamOutput)
+	}
+	s := &outputStream{kind: kind, maxBytes: w.input.StreamMaxBytes}
+	if s.maxBytes <= 0 {
+		s.maxBytes = defaultStreamMaxBytes
+	}
+	for _, r := range w.input.Redact {
+		re, err := regexp.Compile(r)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid redact expression %s %v", r, err)
+		}
+		s.redact = append(s.redact, re)
+	}
+	return s, nil
+}
+
+// redactText hides the secrets and everything matching the redact
+// expressions of the job
+func (s *outputStream) redactText(text string) string {
+	text = secretPattern.ReplaceAllString(text, "${1}"+redacted)
+	for _, re := range s.redact {
+		text = re.ReplaceAllString(text, redacted)
+	}
+	return text
+}
+
+// streamOutput sends the output produced since the last update, failing to
+// get the output doesn't fail the job. final is set once the job finished,
+// the output is then sent till the end since there is no next refresh.
+func (w *WorkUnit) streamOutput(s *outputStream, final bool) {
+	for w.ctx.Err() == nil {
+		var p *Progress
+		var err error
+		if s.kind == "events" {
+			p, err = w.newEvents(s)
+		} else {
+			p, err = w.newStdout(s, final)
+		}
+		if err != nil {
+			w.glog.Errorf("Error fetching the output of %s %v", w.input.HrefSlug, err)
+			return
+		}
+		if p == nil {
+			return
+		}
+		p.HrefSlug = w.input.HrefSlug
+		w.sendProgress(*p)
+		if !final || !p.Truncated {
+			return
+		}
+	}
+}
+
+// newEvents fetches the events with a counter greater than the last one sent
+func (w *WorkUnit) newEvents(s *outputStream) (*Progress, error) {
+	u, err := w.resolve(strings.TrimSuffix(w.parsedURL.Path, "/") + "/job_events/")
+	if err != nil {
+		return nil, err
+	}
+	values := url.Values{}
+	values.Set("counter__gt", strconv.FormatInt(s.lastCounter, 10))
+	values.Set("order_by", "counter")
+	values.Set("page_size", "200")
+	u.RawQuery = values.Encode()
+
+	body, err := w.fetchOutput(u)
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		Next    interface{}              `json:"next"`
+		Results []map[string]interface{} `json:"results"`
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&result); err != nil {
+		return nil, err
+	}
+
+	p := &Progress{}
+	size := 0
+	for _, e := range result.Results {
+		event := make(map[string]interface{})
+		for _, attr := range eventAttributes {
+			if v, ok := e[attr]; ok {
+				event[attr] = v
+			}
+		}
+		if stdout, ok := event["stdout"].(string); ok {
+			event["stdout"] = s.redactText(stdout)
+		}
+		b, _ := json.Marshal(event)
+		if size+len(b) > s.maxBytes && len(p.Events) > 0 {
+			p.Truncated = true
+			break
+		}
+		size += len(b)
+		n, _ := e["counter"].(json.Number)
+		counter, err := n.Int64()
+		if err != nil {
+			return nil, fmt.Errorf("Invalid counter in job event %v", e["counter"])
+		}
+		s.lastCounter = counter
+		p.Events = append(p.Events, event)
+	}
+	if len(p.Events) == 0 {
+		return nil, nil
+	}
+	// The events of the next page are sent in the next update
+	if result.Next != nil {
+		p.Truncated = true
+	}
+	return p, nil
+}
+
+// newStdout fetches the stdout and sends the part after the last update.
+// The output is redacted before it is cut to the max bytes, the last line
+// is kept till it's complete so a secret isn't split across updates.
+func (w *WorkUnit) newStdout(s *outputStream, final bool) (*Progress, error) {
+	u, err := w.resolve(strings.TrimSuffix(w.parsedURL.Path, "/") + "/stdout/?format=txt")
+	if err != nil {
+		return nil, err
+	}
+	if !s.complete {
+		body, err := w.fetchOutput(u)
+		if err != nil {
+			return nil, err
+		}
+		if len(body) > s.offset {
+			chunk := body[s.offset:]
+			if !final {
+				chunk = chunk[:bytes.LastIndexByte(chunk, '\n')+1]
+			}
+			s.offset += len(chunk)
+			s.pending += s.redactText(string(chunk))
+		}
+		s.complete = final
+	}
+	if s.pending == "" {
+		return nil, nil
+	}
+	p := &Progress{Stdout: s.pending}
+	if len(p.Stdout) > s.maxBytes {
+		p.Stdout = cutText(p.Stdout, s.maxBytes)
+		p.Truncated = true
+	}
+	s.pending = s.pending[len(p.Stdout):]
+	return p, nil
+}
+
+// cutText cuts the text after the last line that fits in max bytes, a
+// longer line is cut on a rune boundary
+func cutText(text string, max int) string {
+	if i := strings.LastIndexByte(text[:max], '\n'); i >= 0 {
+		return text[:i+1]
+	}
+	for n := max; n > 0; n-- {
+		if utf8.RuneStart(text[n]) {
+			return text[:n]
+		}
+	}
+	_, size := utf8.DecodeRuneInString(text)
+	return text[:size]
+}
+
+// fetchOutput gets the output without reporting failures as task errors
+func (w *WorkUnit) fetchOutput(u *url.URL) ([]byte, error) {
+	resp, body, err := w.doRequest("GET", u, nil, true)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("GET %s failed with %s", u.String(), resp.Status)
+	}
+	return body, nil
+}
+
+func (w *WorkUnit) sendProgress(p Progress) {
+	if w.progressChannel == nil {
+		return
+	}
+	select {
+	case w.progressChannel <- p:
+	case <-w.ctx.Done():
+	}
+}
+
+// reportProgress updates the task with the progress of a job, the task
+// stays in the running state unless a workflow is waiting for approvals
+func reportProgress(ctx context.Context, taskURL string, config *CatalogConfig, p Progress) {
+	glog := logger.GetLogger(ctx)
+	tu := taskupdater.MakeTaskUpdater(ctx, taskURL, config.XRHIdentity)
+	msg := map[string]interface{}{"progress": p}
+	state := "running"
+	if len(p.Approvals) > 0 {
+		state = "pending_approval"
+	}
+	if _, err := tu.Do(state, "ok", &msg); err != nil {
+		glog.Errorf("Error updating task %s %v", taskURL, err)
+	}
+}
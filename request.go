@@ -9,7 +9,9 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"runtime/debug"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -17,13 +19,23 @@ import (
 	"github.com/mkanoor/catalog_mqtt_client/internal/jsonwriter"
 	"github.com/mkanoor/catalog_mqtt_client/internal/logger"
 	"github.com/mkanoor/catalog_mqtt_client/internal/tarwriter"
+	"github.com/mkanoor/catalog_mqtt_client/internal/taskerror"
+	"github.com/mkanoor/catalog_mqtt_client/internal/upload"
 	log "github.com/sirupsen/logrus"
 )
 
+// inFlightTasks counts the tasks currently being processed
+var inFlightTasks int32
+
+// queuedTasks counts the tasks waiting for a free task slot
+var queuedTasks int32
+
 type PageWriter interface {
 	Write(name string, b []byte) error
-	Flush() error
-	FlushErrors(msg []string) error
+	Flush(ctx context.Context, jobs []*taskerror.Outcome) error
+	FlushErrors(errs []*taskerror.Error, jobs []*taskerror.Outcome) error
+	FlushPartial(ctx context.Context, errs []*taskerror.Error, jobs []*taskerror.Outcome) error
+	Abort(state string, errs []*taskerror.Error, jobs []*taskerror.Outcome) error
 }
 
 // JobParam stores the single parameter set for a job
@@ -37,17 +49,32 @@ type JobParam struct {
 	RefreshIntervalSeconds int64                  `json:"refresh_interval_seconds"`
 	FetchRelated           []interface{}          `json:"fetch_related"`
 	PagePrefix             string                 `json:"page_prefix"`
+	MaxPages               int                    `json:"max_pages"`
+	ParallelPages          int                    `json:"parallel_pages"`
+	ModifiedSince          interface{}            `json:"modified_since"`
+	ReportDeletions        bool                   `json:"report_deletions"`
+	ExpectedStatus         []int                  `json:"expected_status"`
+	StreamOutput           string                 `json:"stream_output"`
+	StreamMaxBytes         int                    `json:"stream_max_bytes"`
+	Redact                 []string               `json:"redact"`
+	MonitorMode            string                 `json:"monitor_mode"`
+
+	relatedDepth int // the number of relations followed to get to this job
+	id           int // the number of the job in the task
 }
 
 type Page struct {
 	Data []byte
 	Name string
+	job  int // the job that wrote the page
 }
 
 type RequestMessage struct {
 	Context struct {
 		ResponseFormat string     `json:"response_format"`
 		UploadURL      string     `json:"upload_url"`
+		TimeoutSeconds int64      `json:"timeout_seconds"`
+		PartialSuccess bool       `json:"partial_success"`
 		Jobs           []JobParam `json:"jobs"`
 	} `json:"context"`
 	CreatedAt time.Time `json:"created_at"`
@@ -58,9 +85,10 @@ type RequestMessage struct {
 }
 
 type MQTTMessage struct {
-	URL  string `json:"url"`
-	Kind string `json:"kind"`
-	Sent string `json:"string"`
+	URL    string                 `json:"url"`
+	Kind   string                 `json:"kind"`
+	Sent   string                 `json:"string"`
+	Params map[string]interface{} `json:"params"`
 }
 
 // RequestHandler interface allows for easy mocking during testing
@@ -80,6 +108,7 @@ func (drh *DefaultRequestHandler) startHandlingRequests(mqttClient mqtt.Client,
 	shutdown := make(chan struct{})
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 	startMQTTListener(mqttClient, config, wh, shutdown)
+	go startHeartbeat(mqttClient, config, shutdown)
 	done := false
 	for !done {
 		select {
@@ -90,6 +119,7 @@ func (drh *DefaultRequestHandler) startHandlingRequests(mqttClient mqtt.Client,
 			close(shutdown)
 		}
 	}
+	publishStatus(mqttClient, config, "offline")
 	log.Info("MQTT Client Ending")
 }
 
@@ -98,6 +128,10 @@ func startMQTTListener(mqttClient mqtt.Client, config *CatalogConfig, wh WorkHan
 	topic := "out/" + config.GUID
 	log.Infof("Subscribing to topic %s", topic)
 	counter := 0
+	env := &MessageEnv{client: mqttClient, config: config, wh: wh, shutdown: shutdown}
+	if config.MaxConcurrentTasks > 0 {
+		env.slots = make(chan struct{}, config.MaxConcurrentTasks)
+	}
 	fn := func(client mqtt.Client, msg mqtt.Message) {
 		log.Infof("Received a MQTT request %s", string(msg.Payload()))
 		m := MQTTMessage{}
@@ -108,9 +142,8 @@ func startMQTTListener(mqttClient mqtt.Client, config *CatalogConfig, wh WorkHan
 			log.Errorf("Error decoding mqtt json %v", err)
 			return
 		}
-		log.Infof("Process Request %s", m.URL)
 		counter++
-		go processRequest(logger.CtxWithLoggerID(ctx, counter), m.URL, config, wh, shutdown)
+		go routeMessage(logger.CtxWithLoggerID(ctx, counter), m, env)
 	}
 
 	if token := mqttClient.Subscribe(topic, 0, fn); token.Wait() && token.Error() != nil {
@@ -118,6 +151,42 @@ func startMQTTListener(mqttClient mqtt.Client, config *CatalogConfig, wh WorkHan
 	}
 }
 
+// runTask registers the task so that it can be canceled and waits for a
+// free task slot before processing the request so that only
+// MaxConcurrentTasks are processed at the same time
+func runTask(ctx context.Context, url string, config *CatalogConfig, wh WorkHandler, shutdown chan struct{}, slots chan struct{}) {
+	glog := logger.GetLogger(ctx)
+	task := activeTasks.add(ctx, url)
+	if task == nil {
+		glog.Infof("Task %s is already being processed", url)
+		return
+	}
+	defer activeTasks.remove(task)
+	if slots != nil {
+		select {
+		case slots <- struct{}{}:
+		default:
+			depth := atomic.AddInt32(&queuedTasks, 1)
+			glog.Infof("Task %s queued, %d tasks waiting for a free slot", url, depth)
+			select {
+			case slots <- struct{}{}:
+				atomic.AddInt32(&queuedTasks, -1)
+			case <-task.ctx.Done():
+				atomic.AddInt32(&queuedTasks, -1)
+				glog.Infof("Queued task %s canceled", url)
+				reportCanceled(ctx, url, config)
+				return
+			case <-shutdown:
+				atomic.AddInt32(&queuedTasks, -1)
+				glog.Infof("Shutdown received, queued task %s dropped", url)
+				return
+			}
+		}
+		defer func() { <-slots }()
+	}
+	processRequest(ctx, url, config, wh, shutdown)
+}
+
 // Parse the request into RequestMessage
 func parseRequest(b []byte) (*RequestMessage, error) {
 	req := RequestMessage{}
@@ -131,42 +200,104 @@ func parseRequest(b []byte) (*RequestMessage, error) {
 	return &req, nil
 }
 
-func startDispatcher(ctx context.Context, config *CatalogConfig, wc WorkChannels, pw PageWriter, wh WorkHandler) {
+// startDispatcher starts a worker for each job and for every follow up job
+// the workers dispatch (launch -> monitor, fetch_related). A job is in flight
+// from the time it is received till its worker finishes, since a worker sends
+// its follow up jobs before it finishes the task is complete as soon as no
+// job is in flight. The waitChannel is closed when the task is complete, it
+// isn't closed when the dispatcher stops on a shutdown or when the task is
+// stopped since the jobs in flight didn't finish. The progress of the jobs
+// is reported in the order the workers send it along with their pages.
+func startDispatcher(ctx context.Context, config *CatalogConfig, jobs []JobParam, wc WorkChannels, pw PageWriter, progress func(Progress), wh WorkHandler) {
 	glog := logger.GetLogger(ctx)
-	done := false
-	totalCount := 0
-	finishedCount := 0
-	for !done {
+	stopped := false
+	defer func() {
+		if !stopped {
+			close(wc.waitChannel)
+		}
+	}()
+	defer recoverPanic(ctx, nil, wc)
+	inFlight := 0
+	running := 0
+	var queue []JobParam
+
+	dispatch := func(j JobParam) {
+		glog.Infof("Job Input Data %v", j)
+		wc.outcomes.add(&j)
+		inFlight++
+		if config.MaxWorkersPerTask > 0 && running >= config.MaxWorkersPerTask {
+			queue = append(queue, j)
+			glog.Infof("Job %s queued, %d jobs waiting for a worker", j.HrefSlug, len(queue))
+			return
+		}
+		running++
+		wc.outcomes.start(j.id)
+		go startWorker(ctx, config, j, wh, wc)
+	}
+
+	for _, j := range jobs {
+		dispatch(j)
+	}
+
+	for inFlight > 0 {
 		select {
 		case j := <-wc.dispatchChannel:
-			glog.Infof("Job Input Data %v", j)
-			totalCount++
-			go startWorker(ctx, config, j, wh, wc)
-		case <-wc.shutdown:
-			done = true
+			dispatch(j)
+		case p := <-wc.progressChannel:
+			progress(p)
 		case page := <-wc.responseChannel:
 			glog.Infof("Data received on response channel %s", page.Name)
 			pw.Write(page.Name, page.Data)
-		case <-wc.finishedChannel:
-			finishedCount++
-		default:
-			if totalCount > 0 && totalCount == finishedCount {
-				done = true
+			wc.outcomes.page(page.job)
+		case id := <-wc.finishedChannel:
+			wc.outcomes.finish(id)
+			inFlight--
+			running--
+			if len(queue) > 0 {
+				j := queue[0]
+				queue = queue[1:]
+				glog.Infof("Starting queued job %s, %d jobs waiting for a worker", j.HrefSlug, len(queue))
+				running++
+				wc.outcomes.start(j.id)
+				go startWorker(ctx, config, j, wh, wc)
 			}
+		case <-wc.shutdown:
+			glog.Infof("Shutdown received, %d jobs still in flight", inFlight)
+			stopped = true
+			return
+		case <-ctx.Done():
+			glog.Infof("Task stopped %v, %d jobs still in flight", ctx.Err(), inFlight)
+			stopped = true
+			return
 		}
 	}
-	wc.waitChannel <- true
 }
 
 // Process the incoming MQTT Work Request
 // Fetch the Actual WorkPayload and start the work
+// The work is done with a task context that is canceled when the task
+// times out, is canceled from the cloud or the client shuts down, which
+// stops all the workers.
 func processRequest(ctx context.Context, url string, config *CatalogConfig, wh WorkHandler, shutdown chan struct{}) {
 	glog := logger.GetLogger(ctx)
 	defer glog.Info("Request finished")
+	task := activeTasks.get(url)
+	if task == nil {
+		if task = activeTasks.add(ctx, url); task == nil {
+			glog.Infof("Task %s is already being processed", url)
+			return
+		}
+		defer activeTasks.remove(task)
+	}
+	atomic.AddInt32(&inFlightTasks, 1)
+	defer atomic.AddInt32(&inFlightTasks, -1)
 	var pw PageWriter
-	body, err := getWorkPayload(ctx, url)
+	body, err := getWorkPayload(task.ctx, url, config)
 	if err != nil {
 		glog.Errorf("Error reading payload in %s %v", url, err)
+		if task.isCanceled() {
+			reportCanceled(ctx, url, config)
+		}
 		return
 	}
 
@@ -177,36 +308,61 @@ func processRequest(ctx context.Context, url string, config *CatalogConfig, wh W
 	}
 	switch strings.ToLower(req.Context.ResponseFormat) {
 	case "tar":
-		pw, err = tarwriter.MakeTarWriter(ctx, url, req.Context.UploadURL)
+		pw, err = tarwriter.MakeTarWriter(ctx, url, req.Context.UploadURL, config.XRHIdentity,
+			upload.Credentials{User: config.UploadUser, Password: config.UploadPassword})
 		if err != nil {
 			glog.Errorf("Error creating Tar Writer")
 			return
 		}
 	case "json":
-		pw = jsonwriter.MakeJSONWriter(ctx, url)
+		pw = jsonwriter.MakeJSONWriter(ctx, url, config.XRHIdentity)
 	default:
 		glog.Errorf("Invalid response format %s for url %s", req.Context.ResponseFormat, url)
 		return
 	}
 
+	timeout := config.TaskTimeout
+	if req.Context.TimeoutSeconds > 0 {
+		timeout = time.Duration(req.Context.TimeoutSeconds) * time.Second
+	}
+	var taskCtx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		taskCtx, cancel = context.WithTimeout(task.ctx, timeout)
+	} else {
+		taskCtx, cancel = context.WithCancel(task.ctx)
+	}
+	defer cancel()
+
 	wc := WorkChannels{}
-	wc.errorChannel = make(chan string)
+	wc.errorChannel = make(chan *taskerror.Error)
 	wc.dispatchChannel = make(chan JobParam)
 	wc.responseChannel = make(chan Page)
-	wc.finishedChannel = make(chan bool)
+	wc.progressChannel = make(chan Progress)
+	wc.finishedChannel = make(chan int)
 	wc.waitChannel = make(chan bool)
-	defer close(wc.errorChannel)
-	defer close(wc.dispatchChannel)
-	defer close(wc.finishedChannel)
-	defer close(wc.responseChannel)
-
 	wc.shutdown = shutdown
-	go startDispatcher(ctx, config, wc, pw, wh)
+	wc.task = task
+	wc.outcomes = newJobOutcomes()
+	progress := func(p Progress) { reportProgress(ctx, url, config, p) }
+	go startDispatcher(taskCtx, config, req.Context.Jobs, wc, pw, progress, wh)
 
-	for _, j := range req.Context.Jobs {
-		wc.dispatchChannel <- j
+	var allErrors []*taskerror.Error
+	stop := func() {
+		cancel()
+		if task.isCanceled() {
+			glog.Info("Task canceled")
+			pw.Abort("canceled", append(allErrors, taskerror.New(taskerror.Canceled, "Task canceled")), wc.outcomes.list())
+			return
+		}
+		glog.Infof("Task timed out after %v", timeout)
+		pw.Abort("timedout", append(allErrors, taskerror.New(taskerror.Timeout, fmt.Sprintf("Task timed out after %v", timeout))), wc.outcomes.list())
+	}
+	shutdownTask := func() {
+		glog.Infof("Shutdown received")
+		cancel()
+		pw.FlushErrors(append(allErrors, taskerror.New(taskerror.Shutdown, "Client is shutting down")), wc.outcomes.list())
 	}
-	var allErrors []string
 	allDone := false
 	for !allDone {
 		select {
@@ -214,36 +370,53 @@ func processRequest(ctx context.Context, url string, config *CatalogConfig, wh W
 			glog.Info("Workers finished")
 			allDone = true
 		case data := <-wc.errorChannel:
-			glog.Infof("Error received %s", data)
+			glog.Infof("Error received %v", data)
 			allErrors = append(allErrors, data)
-		case <-time.After(10 * time.Minute):
-			glog.Infof("Waitgroup timedout")
-			allDone = true
+			wc.outcomes.addError(data)
+		case <-taskCtx.Done():
+			stop()
+			return
 		case <-wc.shutdown:
-			glog.Infof("SHutdown received")
-			allDone = true
+			shutdownTask()
+			return
 		}
 	}
 
-	if len(allErrors) > 0 {
-		pw.FlushErrors(allErrors)
-	} else {
-		pw.Flush()
+	// The workers can finish while the task is being stopped, a stopped
+	// task is never reported as complete and its sync state isn't saved
+	select {
+	case <-wc.shutdown:
+		shutdownTask()
+		return
+	default:
+	}
+	if taskCtx.Err() != nil || task.isCanceled() {
+		stop()
+		return
+	}
+
+	jobs := wc.outcomes.list()
+	if len(allErrors) > 0 && req.Context.PartialSuccess {
+		// The sync state isn't saved, the next sync starts from the
+		// last complete collection
+		pw.FlushPartial(taskCtx, allErrors, jobs)
+	} else if len(allErrors) > 0 {
+		pw.FlushErrors(allErrors, jobs)
+	} else if err := pw.Flush(taskCtx, jobs); err == nil {
+		task.commitSync(ctx)
 	}
 
 }
 
-func getWorkPayload(ctx context.Context, url string) ([]byte, error) {
+func getWorkPayload(ctx context.Context, url string, config *CatalogConfig) ([]byte, error) {
 	glog := logger.GetLogger(ctx)
-	client := &http.Client{}
-	xrh := "eyJlbnRpdGxlbWVudHMiOnsiaW5zaWdodHMiOnsiaXNfZW50aXRsZWQiOnRydWUsImlzX3RyaWFsIjpmYWxzZX0sImNvc3RfbWFuYWdlbWVudCI6eyJpc19lbnRpdGxlZCI6dHJ1ZSwiaXNfdHJpYWwiOmZhbHNlfSwibWlncmF0aW9ucyI6eyJpc19lbnRpdGxlZCI6dHJ1ZSwiaXNfdHJpYWwiOmZhbHNlfSwiYW5zaWJsZSI6eyJpc19lbnRpdGxlZCI6dHJ1ZSwiaXNfdHJpYWwiOmZhbHNlfSwidXNlcl9wcmVmZXJlbmNlcyI6eyJpc19lbnRpdGxlZCI6dHJ1ZSwiaXNfdHJpYWwiOmZhbHNlfSwib3BlbnNoaWZ0Ijp7ImlzX2VudGl0bGVkIjp0cnVlLCJpc190cmlhbCI6ZmFsc2V9LCJzbWFydF9tYW5hZ2VtZW50Ijp7ImlzX2VudGl0bGVkIjp0cnVlLCJpc190cmlhbCI6ZmFsc2V9LCJzdWJzY3JpcHRpb25zIjp7ImlzX2VudGl0bGVkIjp0cnVlLCJpc190cmlhbCI6ZmFsc2V9LCJzZXR0aW5ncyI6eyJpc19lbnRpdGxlZCI6dHJ1ZSwiaXNfdHJpYWwiOmZhbHNlfX0sImlkZW50aXR5Ijp7ImludGVybmFsIjp7ImF1dGhfdGltZSI6Nzk5LCJvcmdfaWQiOiIxMTc4OTc3MiJ9LCJhY2NvdW50X251bWJlciI6IjYwODk3MTkiLCJhdXRoX3R5cGUiOiJiYXNpYy1hdXRoIiwidXNlciI6eyJpc19hY3RpdmUiOnRydWUsImxvY2FsZSI6ImVuX1VTIiwiaXNfb3JnX2FkbWluIjp0cnVlLCJ1c2VybmFtZSI6Imluc2lnaHRzLXFhIiwiZW1haWwiOiJkYWpvaG5zb0ByZWRoYXQuY29tIiwiZmlyc3RfbmFtZSI6Ikluc2lnaHRzIiwidXNlcl9pZCI6IjUxODM0Nzc2IiwibGFzdF9uYW1lIjoiUUEiLCJpc19pbnRlcm5hbCI6dHJ1ZX0sInR5cGUiOiJVc2VyIn19"
-
-	req, err := http.NewRequest("GET", url, nil)
+	client := &http.Client{Timeout: time.Minute}
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		glog.Errorf("Error creating request %s %v", url, err)
 		return nil, err
 	}
-	req.Header.Add("x-rh-identity", xrh)
+	req.Header.Add("x-rh-identity", config.XRHIdentity)
 	resp, err := client.Do(req)
 	if err != nil {
 		glog.Errorf("Error fetching request %s %v", url, err)
@@ -259,6 +432,33 @@ func startWorker(ctx context.Context, config *CatalogConfig, job JobParam, wh Wo
 	glog := logger.GetLogger(ctx)
 	glog.Info("Worker starting")
 	defer glog.Info("Worker finished")
+	defer func() {
+		select {
+		case wc.finishedChannel <- job.id:
+		case <-ctx.Done():
+		}
+	}()
+	defer recoverPanic(ctx, &job, wc)
 	wh.StartWork(ctx, config, job, nil, wc)
-	wc.finishedChannel <- true
+}
+
+// recoverPanic turns a panic of a worker or of the dispatcher into a task
+// error so a single job can't crash the client
+func recoverPanic(ctx context.Context, job *JobParam, wc WorkChannels) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	glog := logger.GetLogger(ctx)
+	glog.Errorf("Recovered from panic %v\n%s", r, debug.Stack())
+	e := taskerror.New(taskerror.Panic, fmt.Sprintf("%v", r))
+	if job != nil {
+		e.Job = job.HrefSlug
+		e.Method = job.Method
+		e.JobID = job.id
+	}
+	select {
+	case wc.errorChannel <- e:
+	case <-ctx.Done():
+	}
 }
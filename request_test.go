@@ -1,65 +1,672 @@
 package main
 
 import (
-	"bytes"
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/mkanoor/catalog_mqtt_client/internal/logger"
+	"github.com/mkanoor/catalog_mqtt_client/internal/taskerror"
 	log "github.com/sirupsen/logrus"
 )
 
-func TestGetRequest(t *testing.T) {
-	b := []byte(`{"account":"12345","sender":"buzz", "message_id":"4567","payload":{"jobs": [{"method":"monitor","href_slug":"/api/v2/jobs/7008","accept_encoding":"gzip"}]}}`)
-	log.SetOutput(os.Stdout)
-	drh := &DefaultRequestHandler{}
-	bo := bytes.NewBuffer(b)
-	b, err := drh.getRequest(bo)
-	if err != nil {
-		t.Fatalf("Error getting request data %v", err)
-	}
+const testPayload = `{"id":"1","state":"pending","context":{"response_format":"json","upload_url":"","jobs": [{"method":"monitor","href_slug":"/api/v2/jobs/7008","accept_encoding":"gzip"},{"method":"get","href_slug":"/api/v2/inventories/899"}]}}`
+
+// fakeTaskServer serves the task payload on GET and records the state of
+// the task updates sent with PATCH
+func fakeTaskServer(t *testing.T, payload string, identity string) (*httptest.Server, *[]string) {
+	var mu sync.Mutex
+	var states []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("x-rh-identity") != identity {
+			t.Errorf("Invalid identity header %s", r.Header.Get("x-rh-identity"))
+		}
+		switch r.Method {
+		case http.MethodGet:
+			w.Write([]byte(payload))
+		case http.MethodPatch:
+			var update map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&update)
+			mu.Lock()
+			states = append(states, fmt.Sprint(update["state"]))
+			mu.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	return ts, &states
 }
-func TestGetRequestNewLine(t *testing.T) {
-	b := []byte(`{"account":"12345","sender":"buzz", "message_id":"4567","payload":{"jobs": [{"method":"monitor","href_slug":"/api/v2/jobs/7008","accept_encoding":"gzip"}]}}\n abab`)
+
+func TestGetWorkPayload(t *testing.T) {
 	log.SetOutput(os.Stdout)
-	bo := bytes.NewBuffer(b)
-	drh := &DefaultRequestHandler{}
-	b, err := drh.getRequest(bo)
+	ts, _ := fakeTaskServer(t, testPayload, "abc")
+	defer ts.Close()
+	b, err := getWorkPayload(testContext(), ts.URL, &CatalogConfig{XRHIdentity: "abc"})
 	if err != nil {
 		t.Fatalf("Error getting request data %v", err)
 	}
+	if string(b) != testPayload {
+		t.Fatalf("Payload does not match %s", string(b))
+	}
 }
 
 func TestParseRequest(t *testing.T) {
-	b := []byte(`{"account":"12345","sender":"buzz", "message_id":"4567","payload":{"jobs": [{"method":"monitor","href_slug":"/api/v2/jobs/7008","accept_encoding":"gzip"}]}}`)
 	log.SetOutput(os.Stdout)
-	drh := &DefaultRequestHandler{}
-	_, err := drh.parseRequest(b)
+	req, err := parseRequest([]byte(testPayload))
 	if err != nil {
 		t.Fatalf("Error parsing request data %v", err)
 	}
+	if len(req.Context.Jobs) != 2 {
+		t.Fatalf("Expected 2 jobs got %d", len(req.Context.Jobs))
+	}
+	if req.Context.Jobs[0].HrefSlug != "/api/v2/jobs/7008" {
+		t.Fatalf("Invalid href_slug %s", req.Context.Jobs[0].HrefSlug)
+	}
 }
 
 type FakeHandler struct {
+	mu          sync.Mutex
 	timesCalled int
 }
 
-func (fh *FakeHandler) StartWork(config *CatalogConfig, params JobParam, client *http.Client, channel chan ResponsePayload) error {
+func (fh *FakeHandler) StartWork(ctx context.Context, config *CatalogConfig, params JobParam, client *http.Client, wc WorkChannels) error {
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
 	fh.timesCalled++
 	return nil
 }
 
 func TestProcessRequest(t *testing.T) {
-	b := []byte(`{"account":"12345","sender":"buzz", "message_id":"4567","payload":{"jobs": [{"method":"monitor","href_slug":"/api/v2/jobs/7008","accept_encoding":"gzip"},{"method":"get","href_slug":"/api/v2/inventories/899"}]}}`)
 	log.SetOutput(os.Stdout)
-	drh := &DefaultRequestHandler{}
-	req, err := drh.parseRequest(b)
-	if err != nil {
-		t.Fatalf("Error parsing request data %v", err)
-	}
+	ts, updates := fakeTaskServer(t, testPayload, "abc")
+	defer ts.Close()
 	fh := FakeHandler{}
-	drh.processRequest(req, CatalogConfig{}, &fh)
+	processRequest(testContext(), ts.URL, &CatalogConfig{XRHIdentity: "abc"}, &fh, make(chan struct{}))
 	if fh.timesCalled != 2 {
 		t.Fatalf("2 workers should have been started only %d were started", fh.timesCalled)
 	}
+	if len(*updates) != 1 {
+		t.Fatalf("Task should have been updated once, got %d updates", len(*updates))
+	}
+}
+
+// concurrencyHandler records the maximum number of workers running at once
+type concurrencyHandler struct {
+	mu          sync.Mutex
+	running     int
+	maxRunning  int
+	timesCalled int
+}
+
+func (ch *concurrencyHandler) StartWork(ctx context.Context, config *CatalogConfig, params JobParam, client *http.Client, wc WorkChannels) error {
+	ch.mu.Lock()
+	ch.running++
+	ch.timesCalled++
+	if ch.running > ch.maxRunning {
+		ch.maxRunning = ch.running
+	}
+	ch.mu.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	ch.mu.Lock()
+	ch.running--
+	ch.mu.Unlock()
+	return nil
+}
+
+func TestMaxWorkersPerTask(t *testing.T) {
+	log.SetOutput(os.Stdout)
+	payload := `{"context":{"response_format":"json","jobs": [{"method":"get","href_slug":"/api/v2/hosts/1"},{"method":"get","href_slug":"/api/v2/hosts/2"},{"method":"get","href_slug":"/api/v2/hosts/3"},{"method":"get","href_slug":"/api/v2/hosts/4"},{"method":"get","href_slug":"/api/v2/hosts/5"}]}}`
+	ts, _ := fakeTaskServer(t, payload, "abc")
+	defer ts.Close()
+	ch := &concurrencyHandler{}
+	processRequest(testContext(), ts.URL, &CatalogConfig{XRHIdentity: "abc", MaxWorkersPerTask: 2}, ch, make(chan struct{}))
+	if ch.timesCalled != 5 {
+		t.Fatalf("5 workers should have been started only %d were started", ch.timesCalled)
+	}
+	if ch.maxRunning > 2 {
+		t.Fatalf("At most 2 workers should run at once, %d did", ch.maxRunning)
+	}
+}
+
+func TestMaxConcurrentTasks(t *testing.T) {
+	log.SetOutput(os.Stdout)
+	payload := `{"context":{"response_format":"json","jobs": [{"method":"get","href_slug":"/api/v2/hosts/1"}]}}`
+	ts, _ := fakeTaskServer(t, payload, "abc")
+	defer ts.Close()
+	ch := &concurrencyHandler{}
+	config := &CatalogConfig{XRHIdentity: "abc"}
+	slots := make(chan struct{}, 1)
+	var wg sync.WaitGroup
+	for i := 1; i <= 3; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			runTask(logger.CtxWithLoggerID(context.Background(), id), fmt.Sprintf("%s/tasks/%d", ts.URL, id), config, ch, make(chan struct{}), slots)
+		}(i)
+	}
+	wg.Wait()
+	if ch.timesCalled != 3 {
+		t.Fatalf("3 tasks should have been processed only %d were", ch.timesCalled)
+	}
+	if ch.maxRunning > 1 {
+		t.Fatalf("At most 1 task should run at once, %d did", ch.maxRunning)
+	}
+}
+
+// recordingWriter keeps the names of all the pages written
+type recordingWriter struct {
+	mu    sync.Mutex
+	pages map[string]bool
+}
+
+func (rw *recordingWriter) Write(name string, b []byte) error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	rw.pages[name] = true
+	return nil
+}
+
+func (rw *recordingWriter) Flush(ctx context.Context, jobs []*taskerror.Outcome) error {
+	return nil
+}
+
+func (rw *recordingWriter) FlushErrors(errs []*taskerror.Error, jobs []*taskerror.Outcome) error {
+	return nil
+}
+
+func (rw *recordingWriter) FlushPartial(ctx context.Context, errs []*taskerror.Error, jobs []*taskerror.Outcome) error {
+	return nil
+}
+
+func (rw *recordingWriter) Abort(state string, errs []*taskerror.Error, jobs []*taskerror.Outcome) error {
+	return nil
+}
+
+// nestedHandler writes a page for each job and dispatches 3 related jobs
+// till the href_slug is 3 levels deep
+type nestedHandler struct{}
+
+func (nh *nestedHandler) StartWork(ctx context.Context, config *CatalogConfig, params JobParam, client *http.Client, wc WorkChannels) error {
+	wc.responseChannel <- Page{Name: params.HrefSlug}
+	if strings.Count(params.HrefSlug, "/child") < 3 {
+		for i := 0; i < 3; i++ {
+			wc.dispatchChannel <- JobParam{Method: "get", HrefSlug: fmt.Sprintf("%s/child%d", params.HrefSlug, i)}
+		}
+	}
+	return nil
+}
+
+func runDispatcher(t *testing.T, config *CatalogConfig, jobs []JobParam, pw PageWriter, wh WorkHandler) {
+	wc := WorkChannels{}
+	wc.errorChannel = make(chan *taskerror.Error)
+	wc.dispatchChannel = make(chan JobParam)
+	wc.responseChannel = make(chan Page)
+	wc.finishedChannel = make(chan int)
+	wc.waitChannel = make(chan bool)
+	wc.shutdown = make(chan struct{})
+	go startDispatcher(testContext(), config, jobs, wc, pw, nil, wh)
+	select {
+	case <-wc.waitChannel:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Dispatcher did not finish")
+	}
+}
+
+func TestDispatcherNestedJobs(t *testing.T) {
+	log.SetOutput(os.Stdout)
+	for _, workers := range []int{0, 1, 4} {
+		rw := &recordingWriter{pages: make(map[string]bool)}
+		jobs := []JobParam{{Method: "get", HrefSlug: "/a"}, {Method: "get", HrefSlug: "/b"}}
+		runDispatcher(t, &CatalogConfig{MaxWorkersPerTask: workers}, jobs, rw, &nestedHandler{})
+
+		if len(rw.pages) != 80 {
+			t.Fatalf("Expected 80 pages with %d workers got %d", workers, len(rw.pages))
+		}
+		for _, name := range []string{"/a", "/b/child2", "/a/child0/child1/child2"} {
+			if !rw.pages[name] {
+				t.Errorf("Page %s was not written", name)
+			}
+		}
+	}
+}
+
+func TestDispatcherNoJobs(t *testing.T) {
+	log.SetOutput(os.Stdout)
+	rw := &recordingWriter{pages: make(map[string]bool)}
+	runDispatcher(t, &CatalogConfig{}, nil, rw, &nestedHandler{})
+	if len(rw.pages) != 0 {
+		t.Fatalf("No pages should have been written")
+	}
+}
+
+// blockingHandler waits till the task is canceled
+type blockingHandler struct{}
+
+func (bh *blockingHandler) StartWork(ctx context.Context, config *CatalogConfig, params JobParam, client *http.Client, wc WorkChannels) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestProcessRequestTimeout(t *testing.T) {
+	log.SetOutput(os.Stdout)
+	ts, updates := fakeTaskServer(t, testPayload, "abc")
+	defer ts.Close()
+	start := time.Now()
+	processRequest(testContext(), ts.URL, &CatalogConfig{XRHIdentity: "abc", TaskTimeout: 50 * time.Millisecond}, &blockingHandler{}, make(chan struct{}))
+	if time.Since(start) > 5*time.Second {
+		t.Fatalf("Task was not canceled after the timeout")
+	}
+	if len(*updates) != 1 || (*updates)[0] != "timedout" {
+		t.Fatalf("Task should have been updated as timedout, got %v", *updates)
+	}
+}
+
+// lateHandler reports progress and finishes after the task timed out
+type lateHandler struct{}
+
+func (lh *lateHandler) StartWork(ctx context.Context, config *CatalogConfig, params JobParam, client *http.Client, wc WorkChannels) error {
+	wc.progressChannel <- Progress{HrefSlug: params.HrefSlug, Stdout: "PLAY RECAP"}
+	time.Sleep(100 * time.Millisecond)
+	return nil
+}
+
+// busyTaskServer serves the task payload and records the state and the
+// status of the task updates, the progress updates are slow so the task
+// is busy when it's stopped
+func busyTaskServer(t *testing.T, payload string) (*httptest.Server, func() []string) {
+	var mu sync.Mutex
+	var updates []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			w.Write([]byte(payload))
+		case http.MethodPatch:
+			var update map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&update)
+			mu.Lock()
+			updates = append(updates, fmt.Sprintf("%v/%v", update["state"], update["status"]))
+			mu.Unlock()
+			if update["state"] == "running" {
+				time.Sleep(200 * time.Millisecond)
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	return ts, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), updates...)
+	}
+}
+
+func TestProcessRequestTimeoutWhileBusy(t *testing.T) {
+	log.SetOutput(os.Stdout)
+	payload := `{"context":{"response_format":"json","jobs": [{"method":"monitor","href_slug":"/api/v2/jobs/7008"}]}}`
+	ts, updates := busyTaskServer(t, payload)
+	defer ts.Close()
+	processRequest(testContext(), ts.URL, &CatalogConfig{XRHIdentity: "abc", TaskTimeout: 50 * time.Millisecond}, &lateHandler{}, make(chan struct{}))
+	if u := updates(); len(u) != 2 || u[1] != "timedout/error" {
+		t.Fatalf("Task should have been updated as timedout, got %v", u)
+	}
+}
+
+// shutdownHandler reports progress and finishes when the client shuts down
+type shutdownHandler struct{}
+
+func (sh *shutdownHandler) StartWork(ctx context.Context, config *CatalogConfig, params JobParam, client *http.Client, wc WorkChannels) error {
+	wc.progressChannel <- Progress{HrefSlug: params.HrefSlug, Stdout: "PLAY RECAP"}
+	<-wc.shutdown
+	return nil
+}
+
+func TestProcessRequestShutdownWhileBusy(t *testing.T) {
+	log.SetOutput(os.Stdout)
+	payload := `{"context":{"response_format":"json","jobs": [{"method":"monitor","href_slug":"/api/v2/jobs/7008"}]}}`
+	ts, updates := busyTaskServer(t, payload)
+	defer ts.Close()
+	shutdown := make(chan struct{})
+	time.AfterFunc(50*time.Millisecond, func() { close(shutdown) })
+	processRequest(testContext(), ts.URL, &CatalogConfig{XRHIdentity: "abc"}, &shutdownHandler{}, shutdown)
+	if u := updates(); len(u) != 2 || u[1] != "completed/error" {
+		t.Fatalf("Task should have been updated with the shutdown error, got %v", u)
+	}
+}
+
+// stuckHandler blocks till the test releases it
+type stuckHandler struct {
+	release chan struct{}
+}
+
+func (sh *stuckHandler) StartWork(ctx context.Context, config *CatalogConfig, params JobParam, client *http.Client, wc WorkChannels) error {
+	<-sh.release
+	return nil
+}
+
+func TestDispatcherStopped(t *testing.T) {
+	log.SetOutput(os.Stdout)
+	ctx, cancel := context.WithCancel(testContext())
+	wc := WorkChannels{}
+	wc.errorChannel = make(chan *taskerror.Error)
+	wc.dispatchChannel = make(chan JobParam)
+	wc.responseChannel = make(chan Page)
+	wc.finishedChannel = make(chan int)
+	wc.waitChannel = make(chan bool)
+	sh := &stuckHandler{release: make(chan struct{})}
+	defer close(sh.release)
+	done := make(chan bool)
+	go func() {
+		startDispatcher(ctx, &CatalogConfig{}, []JobParam{{Method: "get", HrefSlug: "/a"}}, wc, &recordingWriter{}, nil, sh)
+		done <- true
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Dispatcher did not stop")
+	}
+	select {
+	case <-wc.waitChannel:
+		t.Fatalf("The task should not be complete while a job is in flight")
+	default:
+	}
+}
+
+// progressHandler reports progress for every job
+type progressHandler struct{}
+
+func (ph *progressHandler) StartWork(ctx context.Context, config *CatalogConfig, params JobParam, client *http.Client, wc WorkChannels) error {
+	wc.progressChannel <- Progress{HrefSlug: params.HrefSlug, Stdout: "PLAY RECAP"}
+	return nil
+}
+
+func TestProcessRequestProgress(t *testing.T) {
+	log.SetOutput(os.Stdout)
+	payload := `{"context":{"response_format":"json","jobs": [{"method":"monitor","href_slug":"/api/v2/jobs/7008"}]}}`
+	ts, updates := fakeTaskServer(t, payload, "abc")
+	defer ts.Close()
+	processRequest(testContext(), ts.URL, &CatalogConfig{XRHIdentity: "abc"}, &progressHandler{}, make(chan struct{}))
+	if len(*updates) != 2 || (*updates)[0] != "running" || (*updates)[1] != "completed" {
+		t.Fatalf("Task should have been updated with the progress, got %v", *updates)
+	}
+}
+
+// pageAfterProgressHandler reports progress and then writes the page of
+// the job
+type pageAfterProgressHandler struct{}
+
+func (ph *pageAfterProgressHandler) StartWork(ctx context.Context, config *CatalogConfig, params JobParam, client *http.Client, wc WorkChannels) error {
+	wc.progressChannel <- Progress{HrefSlug: params.HrefSlug, Stdout: "PLAY RECAP"}
+	wc.responseChannel <- Page{Name: params.HrefSlug + "/page1.json", Data: []byte(`{"id": 7008}`), job: params.id}
+	return nil
+}
+
+func TestProcessRequestProgressOrder(t *testing.T) {
+	log.SetOutput(os.Stdout)
+	payload := `{"context":{"response_format":"json","jobs": [{"method":"monitor","href_slug":"/api/v2/jobs/7008"}]}}`
+	ts, rec := taskResultServer(t, payload)
+	defer ts.Close()
+	processRequest(testContext(), ts.URL, &CatalogConfig{XRHIdentity: "abc"}, &pageAfterProgressHandler{}, make(chan struct{}))
+	if len(rec.updates) != 3 {
+		t.Fatalf("Expected 3 task updates got %+v", rec.updates)
+	}
+	if rec.updates[0].Result.Progress == nil || rec.updates[1].Result.ID != 7008 || rec.updates[2].State != "completed" {
+		t.Fatalf("The page should be sent after the progress got %+v", rec.updates)
+	}
+}
+
+// approvalHandler reports a workflow waiting for an approval
+type approvalHandler struct{}
+
+func (ah *approvalHandler) StartWork(ctx context.Context, config *CatalogConfig, params JobParam, client *http.Client, wc WorkChannels) error {
+	wc.progressChannel <- Progress{HrefSlug: params.HrefSlug, Approvals: []PendingApproval{{ID: 30, HrefSlug: "/api/v2/workflow_approvals/30/"}}}
+	return nil
+}
+
+func TestProcessRequestPendingApproval(t *testing.T) {
+	log.SetOutput(os.Stdout)
+	payload := `{"context":{"response_format":"json","jobs": [{"method":"monitor","href_slug":"/api/v2/workflow_jobs/20"}]}}`
+	ts, updates := fakeTaskServer(t, payload, "abc")
+	defer ts.Close()
+	processRequest(testContext(), ts.URL, &CatalogConfig{XRHIdentity: "abc"}, &approvalHandler{}, make(chan struct{}))
+	if len(*updates) != 2 || (*updates)[0] != "pending_approval" || (*updates)[1] != "completed" {
+		t.Fatalf("Task should have been updated as pending_approval, got %v", *updates)
+	}
+}
+
+// panicHandler crashes like a worker getting unexpected data from Tower
+type panicHandler struct{}
+
+func (ph *panicHandler) StartWork(ctx context.Context, config *CatalogConfig, params JobParam, client *http.Client, wc WorkChannels) error {
+	var job map[string]interface{}
+	_ = job["url"].(string)
+	return nil
+}
+
+// taskUpdate has the errors and the outcome of the jobs of a task update
+type taskUpdate struct {
+	State  string `json:"state"`
+	Status string `json:"status"`
+	Result struct {
+		Partial  bool                `json:"partial"`
+		Errors   []taskerror.Error   `json:"errors"`
+		Jobs     []taskerror.Outcome `json:"jobs"`
+		Progress *Progress           `json:"progress"`
+		ID       int                 `json:"id"`
+	} `json:"result"`
+}
+
+// taskRecorder keeps the task updates and the files uploaded
+type taskRecorder struct {
+	mu       sync.Mutex
+	last     taskUpdate
+	updates  []taskUpdate
+	uploaded []string
+}
+
+// taskResultServer serves the task payload, records the task updates and
+// accepts uploads on /upload, UPLOAD_URL in the payload is replaced with
+// the upload URL. Uploads to /upload-fail fail.
+func taskResultServer(t *testing.T, payload string) (*httptest.Server, *taskRecorder) {
+	rec := &taskRecorder{}
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		switch {
+		case r.Method == http.MethodGet:
+			w.Write([]byte(strings.Replace(payload, "UPLOAD_URL", ts.URL+"/upload", 1)))
+		case r.Method == http.MethodPatch:
+			rec.last = taskUpdate{}
+			json.NewDecoder(r.Body).Decode(&rec.last)
+			rec.updates = append(rec.updates, rec.last)
+			w.WriteHeader(http.StatusNoContent)
+		case r.URL.Path == "/upload":
+			rec.uploaded = uploadedFiles(t, r)
+			w.WriteHeader(http.StatusAccepted)
+			w.Write([]byte(`{"request_id": "1"}`))
+		case r.URL.Path == "/upload-fail":
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	return ts, rec
+}
+
+// uploadedFiles lists the files of the uploaded tar
+func uploadedFiles(t *testing.T, r *http.Request) []string {
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		t.Fatalf("Error reading upload %v", err)
+	}
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatalf("Error reading upload %v", err)
+	}
+	var names []string
+	tr := tar.NewReader(gz)
+	for {
+		h, err := tr.Next()
+		if err != nil {
+			break
+		}
+		if h.Typeflag == tar.TypeReg {
+			names = append(names, h.Name)
+		}
+	}
+	return names
+}
+
+func TestProcessRequestPanic(t *testing.T) {
+	log.SetOutput(os.Stdout)
+	ts, rec := taskResultServer(t, testPayload)
+	defer ts.Close()
+	processRequest(testContext(), ts.URL, &CatalogConfig{XRHIdentity: "abc"}, &panicHandler{}, make(chan struct{}))
+
+	errs := rec.last.Result.Errors
+	if rec.last.State != "completed" || len(errs) != 2 {
+		t.Fatalf("Expected the task to be completed with 2 errors got %+v", rec.last)
+	}
+	if errs[0].Category != taskerror.Panic || errs[0].Method == "" || errs[0].Job == "" {
+		t.Errorf("Unexpected error %+v", errs[0])
+	}
+}
+
+// panicWriter crashes when a page is written
+type panicWriter struct {
+	recordingWriter
+}
+
+func (pw *panicWriter) Write(name string, b []byte) error {
+	panic("write failed")
+}
+
+func TestDispatcherPanic(t *testing.T) {
+	log.SetOutput(os.Stdout)
+	ctx, cancel := context.WithCancel(testContext())
+	defer cancel()
+	wc := WorkChannels{}
+	wc.errorChannel = make(chan *taskerror.Error)
+	wc.dispatchChannel = make(chan JobParam)
+	wc.responseChannel = make(chan Page)
+	wc.finishedChannel = make(chan int)
+	wc.waitChannel = make(chan bool)
+	wc.shutdown = make(chan struct{})
+	jobs := []JobParam{{Method: "get", HrefSlug: "/a"}}
+	go startDispatcher(ctx, &CatalogConfig{}, jobs, wc, &panicWriter{}, nil, &nestedHandler{})
+
+	select {
+	case e := <-wc.errorChannel:
+		if e.Category != taskerror.Panic || e.Message != "write failed" {
+			t.Errorf("Unexpected error %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("The panic was not reported")
+	}
+	select {
+	case <-wc.waitChannel:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Dispatcher did not finish")
+	}
+}
+
+// outcomeHandler writes 2 pages for a job unless its href_slug has fail
+type outcomeHandler struct{}
+
+func (oh *outcomeHandler) StartWork(ctx context.Context, config *CatalogConfig, params JobParam, client *http.Client, wc WorkChannels) error {
+	if strings.Contains(params.HrefSlug, "fail") {
+		wc.errorChannel <- &taskerror.Error{Category: taskerror.Tower, Message: "HTTP GET call failed with 500", Job: params.HrefSlug, Status: 500, JobID: params.id}
+		return fmt.Errorf("Job failed")
+	}
+	for i := 1; i <= 2; i++ {
+		wc.responseChannel <- Page{Name: fmt.Sprintf("%s/page%d.json", params.HrefSlug, i), Data: []byte(`{"id": 1}`), job: params.id}
+	}
+	return nil
+}
+
+func checkOutcomes(t *testing.T, jobs []taskerror.Outcome) {
+	if len(jobs) != 2 {
+		t.Fatalf("Expected the outcome of 2 jobs got %+v", jobs)
+	}
+	if jobs[0].HrefSlug != "/api/v2/hosts" || jobs[0].Status != taskerror.StatusOK || jobs[0].Pages != 2 || len(jobs[0].Errors) != 0 {
+		t.Errorf("Unexpected outcome of the first job %+v", jobs[0])
+	}
+	if jobs[1].Status != taskerror.StatusError || jobs[1].Pages != 0 || len(jobs[1].Errors) != 1 || jobs[1].Errors[0].Status != 500 {
+		t.Errorf("Unexpected outcome of the failed job %+v", jobs[1])
+	}
+}
+
+func TestProcessRequestOutcomes(t *testing.T) {
+	log.SetOutput(os.Stdout)
+	payload := `{"context":{"response_format":"json","jobs": [{"method":"get","href_slug":"/api/v2/hosts"},{"method":"get","href_slug":"/api/v2/fail"}]}}`
+	ts, rec := taskResultServer(t, payload)
+	defer ts.Close()
+	processRequest(testContext(), ts.URL, &CatalogConfig{XRHIdentity: "abc"}, &outcomeHandler{}, make(chan struct{}))
+	if rec.last.State != "completed" || rec.last.Status != "error" || len(rec.last.Result.Errors) != 1 {
+		t.Fatalf("Expected the task to be completed with an error got %+v", rec.last)
+	}
+	checkOutcomes(t, rec.last.Result.Jobs)
+
+	payload = `{"context":{"response_format":"json","jobs": [{"method":"get","href_slug":"/api/v2/hosts"}]}}`
+	ts, rec = taskResultServer(t, payload)
+	defer ts.Close()
+	processRequest(testContext(), ts.URL, &CatalogConfig{XRHIdentity: "abc"}, &outcomeHandler{}, make(chan struct{}))
+	jobs := rec.last.Result.Jobs
+	if rec.last.State != "completed" || rec.last.Status != "ok" || len(jobs) != 1 {
+		t.Fatalf("Expected the task to be completed with the outcome of the job got %+v", rec.last)
+	}
+	if jobs[0].HrefSlug != "/api/v2/hosts" || jobs[0].Method != "get" || jobs[0].Status != taskerror.StatusOK || jobs[0].Pages != 2 {
+		t.Errorf("Unexpected outcome of the job %+v", jobs[0])
+	}
+}
+
+func TestProcessRequestPartialSuccess(t *testing.T) {
+	log.SetOutput(os.Stdout)
+	payload := `{"context":{"response_format":"tar","upload_url":"UPLOAD_URL","partial_success":true,
+		"jobs": [{"method":"get","href_slug":"/api/v2/hosts"},{"method":"get","href_slug":"/api/v2/fail"}]}}`
+	ts, rec := taskResultServer(t, payload)
+	defer ts.Close()
+	config := &CatalogConfig{XRHIdentity: "abc", UploadUser: "user", UploadPassword: "secret"}
+	processRequest(testContext(), ts.URL, config, &outcomeHandler{}, make(chan struct{}))
+
+	sort.Strings(rec.uploaded)
+	expected := []string{"api/v2/hosts/page1.json", "api/v2/hosts/page2.json", "errors.json"}
+	if len(rec.uploaded) != 3 {
+		t.Fatalf("Expected the pages and the errors manifest to be uploaded got %v", rec.uploaded)
+	}
+	for i, name := range expected {
+		if !strings.HasSuffix(rec.uploaded[i], name) {
+			t.Errorf("Expected %s to be uploaded got %v", name, rec.uploaded)
+		}
+	}
+	if rec.last.State != "completed" || rec.last.Status != "error" || !rec.last.Result.Partial {
+		t.Fatalf("Expected a partial result got %+v", rec.last)
+	}
+	checkOutcomes(t, rec.last.Result.Jobs)
+}
+
+func TestProcessRequestUploadFailed(t *testing.T) {
+	log.SetOutput(os.Stdout)
+	payload := `{"context":{"response_format":"tar","upload_url":"UPLOAD_URL-fail","partial_success":true,
+		"jobs": [{"method":"get","href_slug":"/api/v2/hosts"},{"method":"get","href_slug":"/api/v2/fail"}]}}`
+	ts, rec := taskResultServer(t, payload)
+	defer ts.Close()
+	config := &CatalogConfig{XRHIdentity: "abc", UploadUser: "user", UploadPassword: "secret"}
+	processRequest(testContext(), ts.URL, config, &outcomeHandler{}, make(chan struct{}))
+
+	errs := rec.last.Result.Errors
+	if rec.last.State != "completed" || rec.last.Status != "error" || rec.last.Result.Partial || len(errs) != 2 {
+		t.Fatalf("Expected the task to be completed with the job and the upload errors got %+v", rec.last)
+	}
+	if errs[1].Category != taskerror.Upload || !strings.Contains(errs[1].Message, "500") {
+		t.Errorf("Unexpected upload error %+v", errs[1])
+	}
+	checkOutcomes(t, rec.last.Result.Jobs)
 }
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/mkanoor/catalog_mqtt_client/internal/backoff"
+)
+
+// doRequest sends a request to Ansible Tower and reads the response. The
+// request is retried following the retry policy in the config, idempotent
+// requests are retried on transport errors and on the retryable status
+// codes, the others only if the connection to Tower could not be made.
+func (w *WorkUnit) doRequest(method string, u *url.URL, body []byte, idempotent bool) (*http.Response, []byte, error) {
+	b := backoff.Backoff{Min: w.config.RetryMinInterval, Max: w.config.RetryMaxInterval}
+	for attempt := 1; ; attempt++ {
+		var reader io.Reader
+		if body != nil {
+			reader = bytes.NewReader(body)
+		}
+		req, err := http.NewRequestWithContext(w.ctx, method, u.String(), reader)
+		if err != nil {
+			w.glog.Errorf("Error %v", err)
+			return nil, nil, err
+		}
+		req.Header.Add("Authorization", "Bearer "+w.config.Token)
+		if body != nil {
+			req.Header.Add("Content-Type", "application/json")
+		}
+
+		var respBody []byte
+		resp, err := w.client.Do(req)
+		if err == nil {
+			respBody, err = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+
+		if attempt >= w.config.RetryMaxAttempts || !w.retryable(resp, err, idempotent) {
+			return resp, respBody, err
+		}
+
+		// The Retry-After of the server can't delay the request more than
+		// the retry policy allows
+		delay := b.Next()
+		if after := retryAfter(resp); after > delay {
+			delay = after
+			if delay > w.config.RetryMaxInterval {
+				delay = w.config.RetryMaxInterval
+			}
+		}
+		if deadline, ok := w.ctx.Deadline(); ok && time.Until(deadline) < delay {
+			w.glog.Infof("%s %s not retried, the task times out in less than %v", method, u.String(), delay)
+			return resp, respBody, err
+		}
+		if err != nil {
+			w.glog.Infof("%s %s failed %v, retrying in %v (attempt %d of %d)", method, u.String(), err, delay, attempt, w.config.RetryMaxAttempts)
+		} else {
+			w.glog.Infof("%s %s Status %s, retrying in %v (attempt %d of %d)", method, u.String(), resp.Status, delay, attempt, w.config.RetryMaxAttempts)
+		}
+		select {
+		case <-w.ctx.Done():
+			return nil, nil, w.ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (w *WorkUnit) retryable(resp *http.Response, err error, idempotent bool) bool {
+	if w.ctx.Err() != nil {
+		return false
+	}
+	if err != nil {
+		return idempotent || isDialError(err)
+	}
+	return idempotent && w.config.RetryStatusCodes.includes(resp.StatusCode)
+}
+
+// isDialError checks if the request failed before it was sent
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// retryAfter returns the delay requested by the Retry-After header which
+// can either be in seconds or a HTTP date
+func retryAfter(resp *http.Response) time.Duration {
+	if resp == nil {
+		return 0
+	}
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mkanoor/catalog_mqtt_client/internal/logger"
+	"github.com/mkanoor/catalog_mqtt_client/internal/taskerror"
+	log "github.com/sirupsen/logrus"
+)
+
+type fakeTransport struct {
+	body          []string
+	status        int
+	statuses      []int   // overrides status for each request
+	errs          []error // transport errors returned for each request
+	header        http.Header
+	urls          []string
+	requestNumber int
+	T             *testing.T
+}
+
+type testScaffold struct {
+	t            *testing.T
+	responseBody []string
+	responses    []map[string]interface{}
+	errorMessage string
+	config       *CatalogConfig
+	client       *http.Client
+	wc           WorkChannels
+	pages        []Page
+	errors       []*taskerror.Error
+	dispatched   []JobParam
+	progress     []Progress
+	done         chan bool
+}
+
+func (f *fakeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	f.urls = append(f.urls, req.URL.String())
+	if f.requestNumber < len(f.errs) && f.errs[f.requestNumber] != nil {
+		f.requestNumber++
+		return nil, f.errs[f.requestNumber-1]
+	}
+	status := f.status
+	if f.requestNumber < len(f.statuses) {
+		status = f.statuses[f.requestNumber]
+	}
+	resp := &http.Response{
+		StatusCode: status,
+		Status:     http.StatusText(status),
+		Body:       ioutil.NopCloser(bytes.NewBufferString(f.body[f.requestNumber])),
+		Header: http.Header{
+			"Content-Type": {"application/json"},
+		},
+	}
+	for k, v := range f.header {
+		resp.Header[k] = v
+	}
+	f.requestNumber++
+	return resp, nil
+}
+
+func fakeClient(t *testing.T, body []string, status int) *http.Client {
+	return &http.Client{
+		Transport: &fakeTransport{body: body, status: status, T: t},
+	}
+}
+
+// channelSetup creates the work channels and collects everything the
+// worker sends on them until the scaffold is stopped
+func (ts *testScaffold) channelSetup() {
+	ts.wc = WorkChannels{}
+	ts.wc.errorChannel = make(chan *taskerror.Error)
+	ts.wc.dispatchChannel = make(chan JobParam)
+	ts.wc.responseChannel = make(chan Page)
+	ts.wc.progressChannel = make(chan Progress)
+	ts.wc.shutdown = make(chan struct{})
+	ts.done = make(chan bool)
+	go func() {
+		for {
+			select {
+			case page := <-ts.wc.responseChannel:
+				ts.pages = append(ts.pages, page)
+			case msg := <-ts.wc.errorChannel:
+				ts.errors = append(ts.errors, msg)
+			case j := <-ts.wc.dispatchChannel:
+				ts.dispatched = append(ts.dispatched, j)
+			case p := <-ts.wc.progressChannel:
+				ts.progress = append(ts.progress, p)
+			case <-ts.wc.shutdown:
+				ts.done <- true
+				return
+			}
+		}
+	}()
+}
+
+func (ts *testScaffold) stop() {
+	close(ts.wc.shutdown)
+	<-ts.done
+}
+
+func (ts *testScaffold) base(t *testing.T, jp JobParam, responseCode int, responseBody []string) {
+	log.SetOutput(os.Stdout)
+	ts.t = t
+	ts.responseBody = responseBody
+	ts.channelSetup()
+	ts.config = &CatalogConfig{Debug: false, URL: "https://192.1.1.1", Token: "123", SkipVerifyCertificate: true}
+	ts.client = fakeClient(t, responseBody, responseCode)
+}
+
+func (ts *testScaffold) runSuccess(t *testing.T, jp JobParam, responseCode int, responseBody []string, responses []map[string]interface{}) {
+	ts.base(t, jp, responseCode, responseBody)
+	ts.responses = responses
+	apiw := &DefaultAPIWorker{}
+	err := apiw.StartWork(testContext(), ts.config, jp, ts.client, ts.wc)
+	ts.stop()
+	if err != nil {
+		t.Fatalf("StartWork failed %v", err)
+	}
+	ts.checkWorkResponse()
+}
+
+// runRetry runs the job with a retry policy of 3 attempts, the fake
+// transport answers each attempt with the given status or error
+func (ts *testScaffold) runRetry(t *testing.T, jp JobParam, statuses []int, errs []error, responseBody []string) error {
+	ts.base(t, jp, 200, responseBody)
+	ts.config.RetryMaxAttempts = 3
+	ts.config.RetryMinInterval = time.Millisecond
+	ts.config.RetryMaxInterval = 10 * time.Millisecond
+	ts.config.RetryStatusCodes = StatusCodes{429, 503}
+	tr := ts.client.Transport.(*fakeTransport)
+	tr.statuses = statuses
+	tr.errs = errs
+	apiw := &DefaultAPIWorker{}
+	err := apiw.StartWork(testContext(), ts.config, jp, ts.client, ts.wc)
+	ts.stop()
+	return err
+}
+
+func (ts *testScaffold) runFail(t *testing.T, jp JobParam, responseCode int, responseBody []string, errorMessage string) {
+	ts.base(t, jp, responseCode, responseBody)
+	ts.errorMessage = errorMessage
+
+	apiw := &DefaultAPIWorker{}
+	err := apiw.StartWork(testContext(), ts.config, jp, ts.client, ts.wc)
+	ts.stop()
+	if err == nil {
+		t.Fatalf("Test should have failed but it succedded")
+	}
+	ts.checkWorkFailure()
+}
+
+func testContext() context.Context {
+	return logger.CtxWithLoggerID(context.Background(), 1)
+}
+
+func (ts *testScaffold) checkWorkFailure() {
+	if len(ts.errors) == 0 {
+		ts.t.Fatalf("Did not receive error payload")
+	}
+	for _, e := range ts.errors {
+		if strings.Contains(e.Error(), ts.errorMessage) {
+			return
+		}
+	}
+	ts.t.Fatalf("Could not find error string %s in %v", ts.errorMessage, ts.errors)
+}
+
+func (ts *testScaffold) checkWorkResponse() {
+	if len(ts.errors) > 0 {
+		ts.t.Fatalf("Unexpected errors %v", ts.errors)
+	}
+	if len(ts.pages) != len(ts.responses) {
+		ts.t.Fatalf("Expected %d pages received %d", len(ts.responses), len(ts.pages))
+	}
+	for i, page := range ts.pages {
+		ts.checkBody(ts.parsePayload(page.Data), ts.responses[i])
+	}
+}
+
+func (ts *testScaffold) checkBody(actual map[string]interface{}, required map[string]interface{}) {
+	for k, v := range required {
+		value, ok := actual[k]
+		if !ok {
+			ts.t.Fatalf("Key Missing %s from Actual data", k)
+			continue
+		}
+		if v == nil || value == nil {
+			continue
+		}
+		if reflect.TypeOf(v).String() == "int" && reflect.TypeOf(value).String() == "json.Number" {
+			continue
+		} else if reflect.TypeOf(v) != reflect.TypeOf(value) {
+			ts.t.Fatalf("Type Mismatch required %v actual %v", reflect.TypeOf(v), reflect.TypeOf(value))
+		}
+	}
+}
+
+func (ts *testScaffold) parsePayload(data []byte) map[string]interface{} {
+	var result map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	err := decoder.Decode(&result)
+	if err != nil {
+		ts.t.Fatalf("Error parsing payload %v", err)
+	}
+	return result
+}
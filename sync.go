@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/mkanoor/catalog_mqtt_client/internal/syncstate"
+	"github.com/mkanoor/catalog_mqtt_client/internal/taskerror"
+)
+
+// idsPageSize is the page size used when fetching the ids of a collection
+const idsPageSize = 200
+
+// syncMargin is subtracted from the start of a sync, the objects modified
+// while the first page was being fetched are collected again next time
+const syncMargin = time.Minute
+
+// syncInfo describes how a collection is fetched when the job asks for the
+// objects modified since the last sync or for the deleted objects
+type syncInfo struct {
+	mode     string // full or delta
+	since    time.Time
+	start    time.Time
+	started  bool // start was set from the first response
+	basePath string
+	idsURL   *url.URL
+}
+
+// prepareSync adds the modified__gt filter to the job params. The job
+// option modified_since is either true to use the time of the last
+// successful collection of the href_slug or a RFC3339 timestamp. Without a
+// previous collection all the objects are fetched.
+func (w *WorkUnit) prepareSync() error {
+	modifiedSince := w.input.ModifiedSince
+	if (modifiedSince == nil || modifiedSince == false) && !w.input.ReportDeletions {
+		return nil
+	}
+
+	// The time of the last sync and the ids of the last collection are
+	// kept in the sync state, a timestamp can be used without it
+	if w.syncStore == nil && (w.input.ReportDeletions || modifiedSince == true) {
+		err := errors.New("modified_since and report_deletions need the sync_state_file to be configured")
+		w.sendError(taskerror.Validation, err.Error())
+		return err
+	}
+
+	s := &syncInfo{mode: "full", start: time.Now().UTC().Add(-syncMargin), basePath: w.parsedURL.Path}
+	switch v := modifiedSince.(type) {
+	case nil, bool:
+		if e, ok := w.syncStore.Get(w.input.HrefSlug); ok && v == true {
+			s.since = e.LastSync
+			s.mode = "delta"
+		}
+	case string:
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			err = fmt.Errorf("Invalid modified_since %s %v", v, err)
+			w.sendError(taskerror.Validation, err.Error())
+			return err
+		}
+		s.since = t
+		s.mode = "delta"
+	default:
+		err := fmt.Errorf("Invalid modified_since %v", v)
+		w.sendError(taskerror.Validation, err.Error())
+		return err
+	}
+
+	if err := w.overrideQueryParams(w.input.Params); err != nil {
+		return err
+	}
+	idsURL := *w.parsedURL
+	values := idsURL.Query()
+	values.Set("page_size", strconv.Itoa(idsPageSize))
+	idsURL.RawQuery = values.Encode()
+	s.idsURL = &idsURL
+
+	if s.mode == "delta" {
+		w.input.Params["modified__gt"] = s.since.Format(time.RFC3339Nano)
+	}
+	w.glog.Infof("Collecting %s in %s mode", w.input.HrefSlug, s.mode)
+	w.sync = s
+	return nil
+}
+
+// startSync takes the start of the sync from the Date of the first
+// response, modified__gt is compared with the clock of Tower and not with
+// the clock of the client
+func (w *WorkUnit) startSync(resp *http.Response) {
+	if w.sync == nil || w.sync.started {
+		return
+	}
+	w.sync.started = true
+	if date, err := http.ParseTime(resp.Header.Get("Date")); err == nil {
+		w.sync.start = date.UTC().Add(-syncMargin)
+	}
+}
+
+// markPage tells the cloud if the page has all the objects or only the
+// objects modified since the last sync
+func (w *WorkUnit) markPage(jsonBody map[string]interface{}) {
+	if w.sync == nil {
+		return
+	}
+	jsonBody["sync_mode"] = w.sync.mode
+	if w.sync.mode == "delta" {
+		jsonBody["modified_since"] = w.sync.since.Format(time.RFC3339Nano)
+	}
+}
+
+// finishSync writes the deleted ids and stages the new sync state, it is
+// saved once the task has been completed
+func (w *WorkUnit) finishSync() error {
+	entry := syncstate.Entry{LastSync: w.sync.start}
+	if w.input.ReportDeletions {
+		ids, err := w.fetchIDs()
+		if err != nil {
+			return err
+		}
+		deleted := []int64{}
+		if previous, ok := w.syncStore.Get(w.input.HrefSlug); ok {
+			deleted = syncstate.Deleted(previous.IDs, ids)
+		}
+		entry.IDs = ids
+		page := map[string]interface{}{"deleted_ids": deleted}
+		w.markPage(page)
+		if err := w.writePage(page, filepath.Join(w.sync.basePath, "deletions.json")); err != nil {
+			w.glog.Errorf("Error %v", err)
+			return err
+		}
+	}
+	if w.syncStore != nil {
+		if err := w.task.stageSync(w.syncStore, w.input.HrefSlug, entry); err != nil {
+			w.glog.Errorf("Error saving sync state %v", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// fetchIDs gets the ids of all the objects in the collection
+func (w *WorkUnit) fetchIDs() ([]int64, error) {
+	var ids []int64
+	err := w.eachPage(w.sync.idsURL, func(body []byte) error {
+		var result struct {
+			Results []struct {
+				ID int64 `json:"id"`
+			} `json:"results"`
+		}
+		if err := json.Unmarshal(body, &result); err != nil {
+			w.glog.Errorf("Error %v", err)
+			return err
+		}
+		for _, r := range result.Results {
+			ids = append(ids, r.ID)
+		}
+		return nil
+	})
+	return ids, err
+}
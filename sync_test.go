@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mkanoor/catalog_mqtt_client/internal/syncstate"
+)
+
+func openTestStore(t *testing.T) (*syncstate.Store, func()) {
+	dir, err := ioutil.TempDir("", "catalog_sync")
+	if err != nil {
+		t.Fatalf("Error creating temp directory %v", err)
+	}
+	store, err := syncstate.Open(filepath.Join(dir, "state.json"))
+	if err != nil {
+		t.Fatalf("Error opening sync state %v", err)
+	}
+	return store, func() { os.RemoveAll(dir) }
+}
+
+func runSync(t *testing.T, store *syncstate.Store, responseBody []string) *testScaffold {
+	jp := JobParam{Method: "get", HrefSlug: "/api/v2/hosts/", FetchAllPages: true, ModifiedSince: true, ReportDeletions: true}
+	ts := &testScaffold{}
+	ts.base(t, jp, 200, responseBody)
+	apiw := &DefaultAPIWorker{syncStore: store}
+	err := apiw.StartWork(testContext(), ts.config, jp, ts.client, ts.wc)
+	ts.stop()
+	if err != nil {
+		t.Fatalf("StartWork failed %v", err)
+	}
+	return ts
+}
+
+func TestDeltaSync(t *testing.T) {
+	store, cleanup := openTestStore(t)
+	defer cleanup()
+	lastSync := time.Date(2020, 10, 3, 12, 0, 0, 0, time.UTC)
+	store.Update(map[string]syncstate.Entry{"/api/v2/hosts/": {LastSync: lastSync, IDs: []int64{1, 2, 3}}})
+
+	ts := runSync(t, store, []string{`{"count": 1, "next": null, "results": [{"id": 2}]}`,
+		`{"count": 2, "next": null, "results": [{"id": 2}, {"id": 3}]}`})
+
+	urls := ts.client.Transport.(*fakeTransport).urls
+	if !strings.Contains(urls[0], "modified__gt=2020-10-03T12%3A00%3A00Z") {
+		t.Errorf("Delta request should filter on modified__gt got %s", urls[0])
+	}
+	if strings.Contains(urls[1], "modified__gt") || !strings.Contains(urls[1], "page_size=200") {
+		t.Errorf("Ids request should fetch the whole collection got %s", urls[1])
+	}
+
+	if len(ts.pages) != 2 {
+		t.Fatalf("Expected 2 pages got %d", len(ts.pages))
+	}
+	page := ts.parsePayload(ts.pages[0].Data)
+	if page["sync_mode"] != "delta" || page["modified_since"] != "2020-10-03T12:00:00Z" {
+		t.Errorf("Page should be marked as delta got %v", page)
+	}
+	deletions := ts.parsePayload(ts.pages[1].Data)
+	if ts.pages[1].Name != "/api/v2/hosts/deletions.json" || fmt.Sprint(deletions["deleted_ids"]) != "[1]" {
+		t.Errorf("Expected id 1 to be deleted got %s %v", ts.pages[1].Name, deletions)
+	}
+
+	e, _ := store.Get("/api/v2/hosts/")
+	if !e.LastSync.After(lastSync) || !reflect.DeepEqual(e.IDs, []int64{2, 3}) {
+		t.Errorf("Sync state was not updated got %v", e)
+	}
+}
+
+func TestFullSync(t *testing.T) {
+	store, cleanup := openTestStore(t)
+	defer cleanup()
+
+	ts := runSync(t, store, []string{`{"count": 1, "next": null, "results": [{"id": 2}]}`,
+		`{"count": 1, "next": null, "results": [{"id": 2}]}`})
+
+	urls := ts.client.Transport.(*fakeTransport).urls
+	if strings.Contains(urls[0], "modified__gt") {
+		t.Errorf("The first sync should fetch everything got %s", urls[0])
+	}
+	if page := ts.parsePayload(ts.pages[0].Data); page["sync_mode"] != "full" {
+		t.Errorf("Page should be marked as full got %v", page)
+	}
+	if _, ok := store.Get("/api/v2/hosts/"); !ok {
+		t.Errorf("Sync state was not saved")
+	}
+}
+
+func TestSyncWithoutStateFile(t *testing.T) {
+	jp := JobParam{Method: "get", HrefSlug: "/api/v2/hosts/", ModifiedSince: true}
+	ts := &testScaffold{}
+	ts.runFail(t, jp, 200, []string{"{}"}, "sync_state_file")
+}
+
+func TestReportDeletionsWithoutStateFile(t *testing.T) {
+	jp := JobParam{Method: "get", HrefSlug: "/api/v2/hosts/", ModifiedSince: "2020-10-03T12:00:00Z", ReportDeletions: true}
+	ts := &testScaffold{}
+	ts.runFail(t, jp, 200, []string{"{}"}, "sync_state_file")
+}
+
+func TestSyncStartFromTower(t *testing.T) {
+	store, cleanup := openTestStore(t)
+	defer cleanup()
+	towerTime := time.Date(2020, 10, 5, 8, 0, 0, 0, time.UTC)
+	jp := JobParam{Method: "get", HrefSlug: "/api/v2/hosts/", ModifiedSince: true}
+	ts := &testScaffold{}
+	ts.base(t, jp, 200, []string{`{"count": 1, "next": null, "results": [{"id": 2}]}`})
+	ts.client.Transport.(*fakeTransport).header = http.Header{"Date": {towerTime.Format(http.TimeFormat)}}
+	err := (&DefaultAPIWorker{syncStore: store}).StartWork(testContext(), ts.config, jp, ts.client, ts.wc)
+	ts.stop()
+	if err != nil {
+		t.Fatalf("StartWork failed %v", err)
+	}
+	if e, _ := store.Get("/api/v2/hosts/"); !e.LastSync.Equal(towerTime.Add(-syncMargin)) {
+		t.Errorf("The sync should start at the time of Tower got %v", e.LastSync)
+	}
+}
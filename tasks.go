@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mkanoor/catalog_mqtt_client/internal/logger"
+	"github.com/mkanoor/catalog_mqtt_client/internal/syncstate"
+	"github.com/mkanoor/catalog_mqtt_client/internal/taskerror"
+	"github.com/mkanoor/catalog_mqtt_client/internal/taskupdater"
+)
+
+// activeTasks has the tasks that are queued or being processed
+var activeTasks = newTaskRegistry()
+
+// runningTask is a task that is queued or being processed, canceling it
+// cancels the context of all its workers
+type runningTask struct {
+	url       string
+	ctx       context.Context
+	cancel    context.CancelFunc
+	mu        sync.Mutex
+	canceled  bool
+	towerJobs map[string]bool
+	fetched   map[string]bool
+	syncStore *syncstate.Store
+	syncState map[string]syncstate.Entry
+}
+
+// taskRegistry keeps the tasks keyed by their task URL
+type taskRegistry struct {
+	mu    sync.Mutex
+	tasks map[string]*runningTask
+}
+
+func newTaskRegistry() *taskRegistry {
+	return &taskRegistry{tasks: make(map[string]*runningTask)}
+}
+
+// add registers a new task, it returns nil if the task is already registered
+func (tr *taskRegistry) add(ctx context.Context, taskURL string) *runningTask {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if _, ok := tr.tasks[taskURL]; ok {
+		return nil
+	}
+	t := &runningTask{url: taskURL, towerJobs: make(map[string]bool), fetched: make(map[string]bool)}
+	t.ctx, t.cancel = context.WithCancel(ctx)
+	tr.tasks[taskURL] = t
+	return t
+}
+
+func (tr *taskRegistry) get(taskURL string) *runningTask {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return tr.tasks[taskURL]
+}
+
+func (tr *taskRegistry) remove(t *runningTask) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if tr.tasks[t.url] == t {
+		delete(tr.tasks, t.url)
+	}
+	t.cancel()
+}
+
+// firstFetch remembers a related URL and the options of its job, it
+// reports if the task didn't fetch it before
+func (t *runningTask) firstFetch(key string) bool {
+	if t == nil {
+		return true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.fetched[key] {
+		return false
+	}
+	t.fetched[key] = true
+	return true
+}
+
+// addTowerJob remembers a job running on Tower so it can be canceled
+func (t *runningTask) addTowerJob(href string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.towerJobs[href] = true
+}
+
+func (t *runningTask) removeTowerJob(href string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.towerJobs, href)
+}
+
+func (t *runningTask) isCanceled() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.canceled
+}
+
+// stageSync keeps the sync state of a collection till the task has been
+// completed, without a task it is saved right away
+func (t *runningTask) stageSync(store *syncstate.Store, href string, e syncstate.Entry) error {
+	if t == nil {
+		return store.Update(map[string]syncstate.Entry{href: e})
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.syncState == nil {
+		t.syncState = make(map[string]syncstate.Entry)
+	}
+	t.syncStore = store
+	t.syncState[href] = e
+	return nil
+}
+
+// commitSync saves the sync state of the collections once the task has
+// been completed so a failed upload is collected again the next time
+func (t *runningTask) commitSync(ctx context.Context) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.syncStore == nil {
+		return
+	}
+	if err := t.syncStore.Update(t.syncState); err != nil {
+		logger.GetLogger(ctx).Errorf("Error saving sync state %v", err)
+	}
+}
+
+// stop marks the task as canceled, stops all its workers and returns
+// the Tower jobs that were still running
+func (t *runningTask) stop() []string {
+	t.mu.Lock()
+	t.canceled = true
+	var jobs []string
+	for href := range t.towerJobs {
+		jobs = append(jobs, href)
+	}
+	t.mu.Unlock()
+	t.cancel()
+	return jobs
+}
+
+// cancelTask cancels a queued or running task and the Tower jobs it
+// launched or is monitoring
+func cancelTask(ctx context.Context, taskURL string, config *CatalogConfig) error {
+	glog := logger.GetLogger(ctx)
+	t := activeTasks.get(taskURL)
+	if t == nil {
+		err := fmt.Errorf("Task %s is not running", taskURL)
+		glog.Errorf("Error canceling task %v", err)
+		return err
+	}
+	glog.Infof("Canceling task %s", taskURL)
+	for _, href := range t.stop() {
+		if err := cancelTowerJob(ctx, config, href); err != nil {
+			glog.Errorf("Error canceling Tower job %s %v", href, err)
+		}
+	}
+	return nil
+}
+
+// cancelTowerJob posts to the cancel endpoint of a Tower job
+func cancelTowerJob(ctx context.Context, config *CatalogConfig, href string) error {
+	glog := logger.GetLogger(ctx)
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	host, err := url.Parse(config.URL)
+	if err != nil {
+		return err
+	}
+	ref, err := url.Parse(href)
+	if err != nil {
+		return err
+	}
+	target := host.ResolveReference(ref)
+	target.Path = strings.TrimSuffix(target.Path, "/") + "/cancel/"
+	target.RawQuery = ""
+	u := target.String()
+	req, err := http.NewRequestWithContext(ctx, "POST", u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Authorization", "Bearer "+config.Token)
+	resp, err := towerClient(config).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	glog.Info("POST " + u + " Status " + resp.Status)
+	// Tower returns 405 if the job has already finished
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusMethodNotAllowed {
+		return fmt.Errorf("Cancel failed with %s %s", resp.Status, string(body))
+	}
+	return nil
+}
+
+// reportCanceled updates a task that was canceled before it was started
+func reportCanceled(ctx context.Context, taskURL string, config *CatalogConfig) {
+	glog := logger.GetLogger(ctx)
+	tu := taskupdater.MakeTaskUpdater(ctx, taskURL, config.XRHIdentity)
+	errs := []*taskerror.Error{taskerror.New(taskerror.Canceled, "Task canceled")}
+	msg := map[string]interface{}{"messages": taskerror.Messages(errs), "errors": errs}
+	if _, err := tu.Do("canceled", "error", &msg); err != nil {
+		glog.Errorf("Error updating task %s %v", taskURL, err)
+	}
+}
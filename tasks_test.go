@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestCancelTask(t *testing.T) {
+	log.SetOutput(os.Stdout)
+	var mu sync.Mutex
+	var paths []string
+	tower := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Authorization") != "Bearer 123" {
+			t.Errorf("Invalid cancel request %s %s", r.Method, r.Header.Get("Authorization"))
+		}
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer tower.Close()
+
+	task := activeTasks.add(testContext(), "http://tasks/1")
+	defer activeTasks.remove(task)
+	task.addTowerJob("/api/v2/jobs/15/")
+
+	err := cancelTask(testContext(), "http://tasks/1", &CatalogConfig{URL: tower.URL, Token: "123"})
+	if err != nil {
+		t.Fatalf("Error canceling task %v", err)
+	}
+	if task.ctx.Err() != context.Canceled || !task.isCanceled() {
+		t.Fatalf("Task context should have been canceled")
+	}
+	if len(paths) != 1 || paths[0] != "/api/v2/jobs/15/cancel/" {
+		t.Fatalf("Tower job should have been canceled got %v", paths)
+	}
+}
+
+func TestCancelUnknownTask(t *testing.T) {
+	log.SetOutput(os.Stdout)
+	if err := cancelTask(testContext(), "http://tasks/missing", &CatalogConfig{}); err == nil {
+		t.Fatalf("Canceling an unknown task should fail")
+	}
+}
+
+func TestRunTaskCanceled(t *testing.T) {
+	log.SetOutput(os.Stdout)
+	ts, updates := fakeTaskServer(t, testPayload, "abc")
+	defer ts.Close()
+	config := &CatalogConfig{URL: "https://192.1.1.1", XRHIdentity: "abc"}
+	done := make(chan struct{})
+	go func() {
+		runTask(testContext(), ts.URL, config, &blockingHandler{}, make(chan struct{}), nil)
+		close(done)
+	}()
+
+	for i := 0; activeTasks.get(ts.URL) == nil; i++ {
+		if i > 100 {
+			t.Fatalf("Task was not registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := cancelTask(testContext(), ts.URL, config); err != nil {
+		t.Fatalf("Error canceling task %v", err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Task did not stop after it was canceled")
+	}
+	if len(*updates) != 1 || (*updates)[0] != "canceled" {
+		t.Fatalf("Task should have been updated as canceled, got %v", *updates)
+	}
+	if activeTasks.get(ts.URL) != nil {
+		t.Fatalf("Task should have been removed from the registry")
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// websocketRecheckInterval is how long the monitor waits for a status
+// change on the websocket before checking the job again in case a message
+// was missed
+const websocketRecheckInterval = 5 * time.Minute
+
+const websocketTimeout = 10 * time.Second
+
+// statusChange is the message sent by Tower on the jobs status_changed group
+type statusChange struct {
+	JobID     int64  `json:"unified_job_id"`
+	Status    string `json:"status"`
+	GroupName string `json:"group_name"`
+}
+
+// statusWatcher receives the job status changes from the Tower websocket,
+// if the websocket fails the watcher falls back to polling
+type statusWatcher struct {
+	conn      *websocket.Conn
+	changes   chan statusChange
+	failed    chan struct{}
+	stop      chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+// watchStatus connects to the Tower websocket and subscribes to the job
+// status changes
+func (w *WorkUnit) watchStatus() (*statusWatcher, error) {
+	u := url.URL{Scheme: "ws", Host: w.hostURL.Host, Path: "/websocket/"}
+	if w.hostURL.Scheme == "https" {
+		u.Scheme = "wss"
+	}
+	cfg, err := websocket.NewConfig(u.String(), w.hostURL.Scheme+"://"+w.hostURL.Host)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Header.Set("Authorization", "Bearer "+w.config.Token)
+	cfg.Dialer = &net.Dialer{Timeout: websocketTimeout}
+	if w.config.SkipVerifyCertificate {
+		cfg.TlsConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	conn, err := websocket.DialConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(websocketTimeout))
+	var accept map[string]interface{}
+	if err := websocket.JSON.Receive(conn, &accept); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if accept["accept"] != true {
+		conn.Close()
+		return nil, fmt.Errorf("Tower websocket did not accept the connection %v", accept)
+	}
+	subscribe := map[string]interface{}{"groups": map[string][]string{"jobs": {"status_changed"}}}
+	if token, ok := accept["xrftoken"]; ok {
+		subscribe["xrftoken"] = token
+	}
+	if err := websocket.JSON.Send(conn, subscribe); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	sw := &statusWatcher{
+		conn:    conn,
+		changes: make(chan statusChange, 16),
+		failed:  make(chan struct{}),
+		stop:    make(chan struct{}),
+	}
+	go sw.read()
+	return sw, nil
+}
+
+func (sw *statusWatcher) read() {
+	defer close(sw.failed)
+	for {
+		var c statusChange
+		if err := websocket.JSON.Receive(sw.conn, &c); err != nil {
+			sw.err = err
+			return
+		}
+		if c.GroupName != "" && c.GroupName != "jobs" {
+			continue
+		}
+		select {
+		case sw.changes <- c:
+		case <-sw.stop:
+			return
+		}
+	}
+}
+
+// wait returns when the status of the job changes, without a websocket
+// it waits for the refresh interval
+func (sw *statusWatcher) wait(ctx context.Context, jobID int64, interval time.Duration) error {
+	if sw == nil {
+		return sleep(ctx, interval)
+	}
+	recheck := time.After(websocketRecheckInterval)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case c := <-sw.changes:
+			if c.JobID == jobID {
+				return nil
+			}
+		case <-sw.failed:
+			return sleep(ctx, interval)
+		case <-recheck:
+			return nil
+		}
+	}
+}
+
+func (sw *statusWatcher) close() {
+	if sw == nil {
+		return
+	}
+	sw.closeOnce.Do(func() {
+		close(sw.stop)
+		sw.conn.Close()
+	})
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
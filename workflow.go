@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/mkanoor/catalog_mqtt_client/internal/artifacts"
+)
+
+// WorkflowNodeStatus is the outcome of a node of a workflow job, nodes
+// that didn't spawn a job have the never_run status
+type WorkflowNodeStatus struct {
+	ID         int64                  `json:"id"`
+	Identifier string                 `json:"identifier,omitempty"`
+	JobID      int64                  `json:"job_id,omitempty"`
+	JobType    string                 `json:"job_type,omitempty"`
+	Name       string                 `json:"name,omitempty"`
+	Status     string                 `json:"status"`
+	Failed     bool                   `json:"failed"`
+	Artifacts  map[string]interface{} `json:"artifacts,omitempty"`
+}
+
+// workflowNode has the attributes of a Tower workflow job node we use
+type workflowNode struct {
+	ID         int64  `json:"id"`
+	Identifier string `json:"identifier"`
+	Job        *int64 `json:"job"`
+	Related    struct {
+		Job string `json:"job"`
+	} `json:"related"`
+	SummaryFields struct {
+		Job struct {
+			Name   string `json:"name"`
+			Status string `json:"status"`
+			Failed bool   `json:"failed"`
+			Type   string `json:"type"`
+		} `json:"job"`
+	} `json:"summary_fields"`
+}
+
+func isWorkflowJob(body []byte) bool {
+	var job struct {
+		Type string `json:"type"`
+	}
+	json.Unmarshal(body, &job)
+	return job.Type == "workflow_job"
+}
+
+// workflowNodes collects the nodes of a finished workflow job and follows
+// the job spawned by each node to get its status and artifacts
+func (w *WorkUnit) workflowNodes(body []byte) ([]WorkflowNodeStatus, error) {
+	nodes := []WorkflowNodeStatus{}
+	err := w.eachWorkflowNode(body, func(n workflowNode) error {
+		status, err := w.nodeStatus(n)
+		if err != nil {
+			return err
+		}
+		nodes = append(nodes, status)
+		return nil
+	})
+	return nodes, err
+}
+
+// eachWorkflowNode fetches all the nodes of the workflow job and calls fn
+// with every node
+func (w *WorkUnit) eachWorkflowNode(body []byte, fn func(n workflowNode) error) error {
+	var job struct {
+		Related struct {
+			WorkflowNodes string `json:"workflow_nodes"`
+		} `json:"related"`
+	}
+	json.Unmarshal(body, &job)
+	href := job.Related.WorkflowNodes
+	if href == "" {
+		href = strings.TrimSuffix(w.parsedURL.Path, "/") + "/workflow_nodes/"
+	}
+	u, err := w.resolve(href)
+	if err != nil {
+		return err
+	}
+
+	return w.eachPage(u, func(page []byte) error {
+		var result struct {
+			Results []workflowNode `json:"results"`
+		}
+		if err := json.Unmarshal(page, &result); err != nil {
+			w.glog.Errorf("Error %v", err)
+			return err
+		}
+		for _, n := range result.Results {
+			if err := fn(n); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (w *WorkUnit) nodeStatus(n workflowNode) (WorkflowNodeStatus, error) {
+	status := WorkflowNodeStatus{ID: n.ID, Identifier: n.Identifier, Status: "never_run"}
+	if n.Job == nil {
+		return status, nil
+	}
+	status.JobID = *n.Job
+	status.JobType = n.SummaryFields.Job.Type
+	status.Name = n.SummaryFields.Job.Name
+	status.Status = n.SummaryFields.Job.Status
+	status.Failed = n.SummaryFields.Job.Failed
+	if n.Related.Job == "" {
+		return status, nil
+	}
+
+	u, err := w.resolve(n.Related.Job)
+	if err != nil {
+		return status, err
+	}
+	body, _, err := w.fetchURL(u)
+	if err != nil {
+		return status, err
+	}
+	var job struct {
+		Name      string                 `json:"name"`
+		Status    string                 `json:"status"`
+		Failed    bool                   `json:"failed"`
+		Artifacts map[string]interface{} `json:"artifacts"`
+	}
+	if err := json.Unmarshal(body, &job); err != nil {
+		w.glog.Errorf("Error %v", err)
+		return status, err
+	}
+	status.Name = job.Name
+	status.Status = job.Status
+	status.Failed = job.Failed
+	if job.Artifacts != nil {
+		status.Artifacts, err = artifacts.Sanctify(job.Artifacts)
+		if err != nil {
+			w.glog.Errorf("Error %v", err)
+			return status, err
+		}
+	}
+	return status, nil
+}
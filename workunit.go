@@ -7,27 +7,35 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"path/filepath"
-	"reflect"
+	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/mkanoor/catalog_mqtt_client/internal/artifacts"
 	"github.com/mkanoor/catalog_mqtt_client/internal/filters"
 	"github.com/mkanoor/catalog_mqtt_client/internal/logger"
+	"github.com/mkanoor/catalog_mqtt_client/internal/ratelimit"
+	"github.com/mkanoor/catalog_mqtt_client/internal/syncstate"
+	"github.com/mkanoor/catalog_mqtt_client/internal/taskerror"
 )
 
 type WorkChannels struct {
 	shutdown        chan struct{}
-	errorChannel    chan string
+	errorChannel    chan *taskerror.Error
 	dispatchChannel chan JobParam
-	finishedChannel chan bool
+	finishedChannel chan int
 	waitChannel     chan bool
 	responseChannel chan Page
+	progressChannel chan Progress
+	task            *runningTask
+	outcomes        *jobOutcomes
 }
 
 type RelatedObject struct {
@@ -41,8 +49,26 @@ type WorkHandler interface {
 	StartWork(ctx context.Context, config *CatalogConfig, params JobParam, client *http.Client, wc WorkChannels) error
 }
 
-// DefaultAPIWorker is struct to start a worker
+// DefaultAPIWorker is struct to start a worker, all the workers share
+// the limiter that throttles the requests to Ansible Tower and the state
+// of the previous collections
 type DefaultAPIWorker struct {
+	limiter   *ratelimit.Limiter
+	syncStore *syncstate.Store
+}
+
+// MakeDefaultAPIWorker creates the worker with the rate limit and the sync
+// state file from the config
+func MakeDefaultAPIWorker(config *CatalogConfig) (*DefaultAPIWorker, error) {
+	aw := &DefaultAPIWorker{limiter: ratelimit.New(config.TowerRequestsPerSecond, config.TowerBurst)}
+	if config.SyncStateFile != "" {
+		store, err := syncstate.Open(config.SyncStateFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading sync state %s %v", config.SyncStateFile, err)
+		}
+		aw.syncStore = store
+	}
+	return aw, nil
 }
 
 // StartWork can be started as a go routine to start a unit of work based on a given JobParam
@@ -51,6 +77,7 @@ func (aw *DefaultAPIWorker) StartWork(ctx context.Context, config *CatalogConfig
 	glog := logger.GetLogger(ctx)
 	glog.Info("Worker starting")
 	w := &WorkUnit{}
+	w.ctx = ctx
 	w.glog = glog
 	w.setConfig(config)
 	w.setJobParameters(params)
@@ -58,18 +85,37 @@ func (aw *DefaultAPIWorker) StartWork(ctx context.Context, config *CatalogConfig
 	w.shutdown = wc.shutdown
 	w.dispatchChannel = wc.dispatchChannel
 	w.responseChannel = wc.responseChannel
+	w.progressChannel = wc.progressChannel
+	w.task = wc.task
+	w.syncStore = aw.syncStore
 	err := w.setURL()
 	if err != nil {
 		glog.Errorf("Error %v", err)
 		return err
 	}
 	w.setClient(client)
+	w.setLimiter(aw.limiter)
 	w.glog.Info("Dispatch started")
-	return w.dispatch()
+	err = w.dispatch()
+	if err != nil && atomic.LoadInt32(&w.errorSent) == 0 && ctx.Err() == nil {
+		w.sendError(errorCategory(err), err.Error())
+	}
+	return err
+}
+
+// errorCategory tells apart the failures to reach Tower from the other
+// failures of a job
+func errorCategory(err error) string {
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return taskerror.Transport
+	}
+	return taskerror.Internal
 }
 
 // WorkUnit is a data struct to store a single unit of work
 type WorkUnit struct {
+	ctx             context.Context
 	glog            logger.Logger
 	config          *CatalogConfig
 	hostURL         *url.URL
@@ -78,11 +124,16 @@ type WorkUnit struct {
 	filterValue     *filters.Value
 	parsedURL       *url.URL
 	parsedValues    url.Values
-	errorChannel    chan string
+	errorChannel    chan *taskerror.Error
 	dispatchChannel chan JobParam
 	responseChannel chan Page
+	progressChannel chan Progress
 	shutdown        chan struct{}
 	relatedObjects  []RelatedObject
+	task            *runningTask
+	syncStore       *syncstate.Store
+	sync            *syncInfo
+	errorSent       int32 // set atomically, the pages can be fetched in parallel
 }
 
 func (w *WorkUnit) setConfig(p *CatalogConfig) {
@@ -108,9 +159,8 @@ func (w *WorkUnit) setJobParameters(data JobParam) {
 }
 
 func (w *WorkUnit) setRelatedObjects(data JobParam) {
-	if data.FetchRelated != nil {
-		for _, o := range data.FetchRelated {
-			obj := o.(map[string]interface{})
+	for _, o := range data.FetchRelated {
+		if obj, ok := o.(map[string]interface{}); ok {
 			w.setRelated(obj)
 		}
 	}
@@ -119,30 +169,87 @@ func (w *WorkUnit) setRelatedObjects(data JobParam) {
 func (w *WorkUnit) setClient(c *http.Client) error {
 	w.glog.Infof("Setting client %v", c)
 	if c == nil {
-		var tr *http.Transport
-		if w.config.SkipVerifyCertificate {
-			config := &tls.Config{InsecureSkipVerify: true}
-			tr = &http.Transport{TLSClientConfig: config}
-		}
-		w.client = &http.Client{Transport: tr}
+		w.client = towerClient(w.config)
 	} else {
 		w.client = c
 	}
 	return nil
 }
 
+// setLimiter makes every request of the work unit wait for the limiter
+func (w *WorkUnit) setLimiter(l *ratelimit.Limiter) {
+	if l == nil {
+		return
+	}
+	next := w.client.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	w.client = &http.Client{
+		Transport:     &rateLimitedTransport{limiter: l, next: next},
+		CheckRedirect: w.client.CheckRedirect,
+		Jar:           w.client.Jar,
+		Timeout:       w.client.Timeout,
+	}
+}
+
+// rateLimitedTransport waits for a token before sending a request, the
+// rate is lowered when Tower answers with 429 Too Many Requests
+type rateLimitedTransport struct {
+	limiter *ratelimit.Limiter
+	next    http.RoundTripper
+}
+
+func (rt *rateLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := rt.limiter.Wait(req.Context()); err != nil {
+		return nil, err
+	}
+	resp, err := rt.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		rt.limiter.Slowdown()
+	} else {
+		rt.limiter.Speedup()
+	}
+	return resp, nil
+}
+
+// towerClient creates the HTTP client used to talk to Ansible Tower
+func towerClient(config *CatalogConfig) *http.Client {
+	client := &http.Client{}
+	if config.SkipVerifyCertificate {
+		client.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	}
+	return client
+}
+
 func (w *WorkUnit) dispatch() error {
 	var err error
 	switch strings.ToLower(w.input.Method) {
 	case "get":
 		err = w.get()
 	case "post", "launch":
-		err = w.post()
+		err = w.send("POST")
+	case "put":
+		err = w.send("PUT")
+	case "patch":
+		err = w.send("PATCH")
+	case "delete":
+		err = w.send("DELETE")
 	case "monitor":
 		err = w.monitor()
+	case "approve", "deny":
+		err = w.decide(strings.ToLower(w.input.Method))
 	default:
-		err = errors.New("Invalid method received " + w.input.Method)
-		w.sendError(err.Error(), 0)
+		action, ok := jobActions[strings.ToLower(w.input.Method)]
+		if !ok {
+			err = errors.New("Invalid method received " + w.input.Method)
+			w.sendError(taskerror.Validation, err.Error())
+			break
+		}
+		err = w.runAction(action)
 	}
 	return err
 }
@@ -168,15 +275,17 @@ func (w *WorkUnit) setURL() error {
 func (w *WorkUnit) setRelated(data map[string]interface{}) error {
 	r := RelatedObject{}
 	for key, element := range data {
-		switch v := element.(type) {
-		case string:
-			if key == "href_slug" {
-				r.relAttribute = v
-			} else if key == "predicate" {
-				r.predicate = v
-			} else if key == "apply_filter" {
-				r.jobExtra.ApplyFilter = v
-			}
+		switch key {
+		case "href_slug":
+			r.relAttribute, _ = element.(string)
+		case "predicate":
+			r.predicate, _ = element.(string)
+		case "apply_filter":
+			r.jobExtra.ApplyFilter = element
+		case "fetch_all_pages":
+			r.jobExtra.FetchAllPages, _ = element.(bool)
+		case "fetch_related":
+			r.jobExtra.FetchRelated, _ = element.([]interface{})
 		}
 	}
 	// If there is no href_slug ignore this relation
@@ -204,7 +313,7 @@ func (w *WorkUnit) overrideQueryParams(override map[string]interface{}) error {
 		}
 	}
 	for key, element := range w.parsedValues {
-		w.glog.Infof("Key:", key, "=>", "Element:", element[0])
+		w.glog.Infof("Key: %s => Element: %s", key, element[0])
 	}
 	w.parsedURL.RawQuery = w.parsedValues.Encode()
 	return nil
@@ -226,76 +335,113 @@ func (w *WorkUnit) getPage() ([]byte, int, error) {
 		w.glog.Errorf("Error %v", err)
 		return nil, 0, err
 	}
+	return w.fetchPage()
+}
 
-	req, err := http.NewRequest("GET", w.parsedURL.String(), nil)
-	req.Header.Add("Authorization", "Bearer "+w.config.Token)
-	resp, err := w.client.Do(req)
-	if err != nil {
-		w.glog.Errorf("Error %v", err)
-		return nil, 0, err
-	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
+// fetchPage gets the current URL without applying the job params
+func (w *WorkUnit) fetchPage() ([]byte, int, error) {
+	return w.fetchURL(w.parsedURL)
+}
+
+func (w *WorkUnit) fetchURL(u *url.URL) ([]byte, int, error) {
+	resp, body, err := w.doRequest("GET", u, nil, true)
 	if err != nil {
 		w.glog.Errorf("Error %v", err)
 		return nil, 0, err
 	}
 
-	w.glog.Info("GET " + w.parsedURL.String() + " Status " + resp.Status)
+	w.glog.Info("GET " + u.String() + " Status " + resp.Status)
 
-	err = w.validateHTTPResponse(resp, body)
+	err = w.validateHTTPResponse("GET", resp, body, nil)
 	if err != nil {
 		return nil, 0, err
 	}
+	w.startSync(resp)
 	return []byte(body), resp.StatusCode, nil
 }
 
-func (w *WorkUnit) validateHTTPResponse(resp *http.Response, body []byte) error {
-	if !successHTTPCode(resp.StatusCode) {
-		err := errors.New("HTTP GET call failed with " + resp.Status)
-		w.sendError(string(body), resp.StatusCode)
+// validateHTTPResponse checks the status code against the expected codes,
+// without expected codes any success code is accepted
+func (w *WorkUnit) validateHTTPResponse(method string, resp *http.Response, body []byte, expected []int) error {
+	valid := successHTTPCode(resp.StatusCode)
+	if len(expected) > 0 {
+		valid = StatusCodes(expected).includes(resp.StatusCode)
+	}
+	if !valid {
+		err := errors.New("HTTP " + method + " call failed with " + resp.Status)
+		e := &taskerror.Error{Category: taskerror.Tower, Message: err.Error(), Status: resp.StatusCode}
+		if resp.Request != nil {
+			e.URL = resp.Request.URL.String()
+		}
+		e.SetBody(body)
+		w.reportError(e)
 		w.glog.Errorf("%v", err)
 		return err
 	}
 	return nil
 }
 
-func (w *WorkUnit) post() error {
-	b, err := json.Marshal(w.input.Params)
-	if err != nil {
-		w.glog.Errorf("Error %v", err)
-		return err
+// defaultExpectedStatus are the status codes accepted for each method
+// when the job doesn't set expected_status
+var defaultExpectedStatus = map[string][]int{
+	"POST":   {200, 201, 202},
+	"PUT":    {200, 201, 204},
+	"PATCH":  {200, 204},
+	"DELETE": {200, 202, 204},
+}
+
+// send the params as the body of a POST, PUT or PATCH request or send a
+// DELETE request and write the response page
+func (w *WorkUnit) send(method string) error {
+	var b []byte
+	var err error
+	if method != "DELETE" {
+		b, err = json.Marshal(w.input.Params)
+		if err != nil {
+			w.glog.Errorf("Error %v", err)
+			return err
+		}
 	}
 
-	req, err := http.NewRequest("POST", w.parsedURL.String(), bytes.NewBuffer(b))
-	req.Header.Add("Authorization", "Bearer "+w.config.Token)
-	req.Header.Add("Content-Type", "application/json")
-	resp, err := w.client.Do(req)
-	if err != nil {
-		w.glog.Errorf("Error %v", err)
-		return err
+	if strings.ToLower(w.input.Method) == "launch" {
+		if err := w.checkLaunch(); err != nil {
+			return err
+		}
 	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
+
+	idempotent := method == "PUT" || method == "DELETE"
+	resp, body, err := w.doRequest(method, w.parsedURL, b, idempotent)
 	if err != nil {
 		w.glog.Errorf("Error %v", err)
 		return err
 	}
-	w.glog.Info("POST " + w.parsedURL.String() + " Status " + resp.Status)
-	err = w.validateHTTPResponse(resp, body)
+	w.glog.Info(method + " " + w.parsedURL.String() + " Status " + resp.Status)
+	expected := w.input.ExpectedStatus
+	if len(expected) == 0 {
+		expected = defaultExpectedStatus[method]
+	}
+	err = w.validateHTTPResponse(method, resp, body, expected)
 	if err != nil {
 		return err
 	}
 
-	job, err := w.writeResponse(body, filepath.Join(w.parsedURL.Path, "response.json"))
+	_, err = w.writeResponse(body, filepath.Join(w.parsedURL.Path, "response.json"))
 	if err != nil {
 		w.glog.Errorf("Error %v", err)
 		return err
 	}
 
 	if strings.ToLower(w.input.Method) == "launch" {
-		u := job["url"].(string)
-		w.dispatchChannel <- JobParam{Method: "monitor", HrefSlug: u, ApplyFilter: w.input.ApplyFilter}
+		u, err := startedJob(body, jobAction{endpoint: "launch"})
+		if err != nil {
+			w.sendError(taskerror.Data, err.Error())
+			w.glog.Errorf("Error %v", err)
+			return err
+		}
+		// Register the job right away so it can be canceled before
+		// the monitor starts
+		w.task.addTowerJob(u)
+		return w.monitorJob(u)
 	}
 	return nil
 }
@@ -306,6 +452,7 @@ func (w *WorkUnit) writeResponse(body []byte, fileName string) (map[string]inter
 		w.glog.Errorf("Error %v", err)
 		return nil, err
 	}
+	w.markPage(jsonBody)
 	err = w.writePage(jsonBody, fileName)
 	if err != nil {
 		w.glog.Errorf("Error %v", err)
@@ -314,51 +461,259 @@ func (w *WorkUnit) writeResponse(body []byte, fileName string) (map[string]inter
 	return jsonBody, nil
 }
 
+// defaultMaxPages stops the pagination if the job doesn't set max_pages
+const defaultMaxPages = 1000
+
+// get fetches the object or collection and when the job asks for it the
+// changes since the last sync
 func (w *WorkUnit) get() error {
+	if err := w.prepareSync(); err != nil {
+		return err
+	}
+	if err := w.getPages(); err != nil {
+		return err
+	}
+	if w.sync != nil {
+		return w.finishSync()
+	}
+	return nil
+}
+
+// getPages fetches the first page, when fetch_all_pages is set the next
+// link returned by Tower is followed till the last page
+func (w *WorkUnit) getPages() error {
+	basePath := w.parsedURL.Path
+	maxPages := w.input.MaxPages
+	if maxPages <= 0 {
+		maxPages = defaultMaxPages
+	}
+	visited := make(map[string]bool)
 
 	body, _, err := w.getPage()
-	if err != nil {
-		w.glog.Errorf("Get failed Error %v", err)
-		return err
+	for page := 1; ; page++ {
+		if err != nil {
+			w.glog.Errorf("Get failed Error %v", err)
+			return err
+		}
+		visited[w.parsedURL.String()] = true
+
+		var jsonBody map[string]interface{}
+		filename := fmt.Sprintf("%s%d.json", w.input.PagePrefix, page)
+		jsonBody, err = w.writeResponse(body, filepath.Join(basePath, filename))
+		if err != nil {
+			w.glog.Errorf("Error %v", err)
+			return err
+		}
+
+		err = w.requestAllRelations(jsonBody)
+		if err != nil {
+			w.glog.Errorf("Error %v", err)
+			return err
+		}
+
+		next := nextLink(body)
+		if !w.input.FetchAllPages || next == "" {
+			return nil
+		}
+		if w.input.ParallelPages > 0 {
+			return w.getPagesInParallel(basePath, body, maxPages)
+		}
+		if page >= maxPages {
+			if w.input.MaxPages <= 0 {
+				return w.truncated(basePath, page)
+			}
+			w.glog.Infof("Stopping after %d pages, %s was not fetched", page, next)
+			return nil
+		}
+
+		var nextURL *url.URL
+		nextURL, err = w.resolve(next)
+		if err != nil {
+			w.glog.Errorf("Error %v", err)
+			return err
+		}
+		if visited[nextURL.String()] {
+			err = fmt.Errorf("Pagination loop detected, %s was already fetched", next)
+			w.sendError(taskerror.Data, err.Error())
+			w.glog.Errorf("Error %v", err)
+			return err
+		}
+		w.parsedURL = nextURL
+		body, _, err = w.fetchPage()
 	}
-	filename := fmt.Sprintf("%s%d.json", w.input.PagePrefix, 1)
+}
 
-	jsonBody, err := w.writeResponse(body, filepath.Join(w.parsedURL.Path, filename))
-	if err != nil {
+// getPagesInParallel computes the number of pages from the count and the
+// page size of the first page and fetches the remaining pages with up to
+// parallel_pages requests at the same time
+func (w *WorkUnit) getPagesInParallel(basePath string, firstPage []byte, maxPages int) error {
+	var first struct {
+		Count   int           `json:"count"`
+		Results []interface{} `json:"results"`
+	}
+	if err := json.Unmarshal(firstPage, &first); err != nil {
 		w.glog.Errorf("Error %v", err)
 		return err
 	}
+	pageSize := len(first.Results)
+	if size, err := strconv.Atoi(w.parsedURL.Query().Get("page_size")); err == nil && size > 0 {
+		pageSize = size
+	}
+	if pageSize == 0 {
+		err := errors.New("Page size can't be determined from the first page")
+		w.sendError(taskerror.Data, err.Error())
+		return err
+	}
+	pages := (first.Count + pageSize - 1) / pageSize
+	truncated := false
+	if pages > maxPages {
+		w.glog.Infof("Stopping after %d pages, the collection has %d pages", maxPages, pages)
+		pages = maxPages
+		truncated = w.input.MaxPages <= 0
+	}
+	w.glog.Infof("Fetching %d pages with %d parallel requests", pages, w.input.ParallelPages)
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	failed := make(chan struct{})
+	slots := make(chan struct{}, w.input.ParallelPages)
+	fetch := func(page int) (err error) {
+		defer w.recoverPanic(&err)
+		return w.getNumberedPage(basePath, page)
+	}
+schedule:
+	for page := 2; page <= pages; page++ {
+		select {
+		case slots <- struct{}{}:
+		case <-failed:
+			break schedule
+		case <-w.ctx.Done():
+			break schedule
+		}
+		wg.Add(1)
+		go func(page int) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			if err := fetch(page); err != nil {
+				once.Do(func() {
+					firstErr = err
+					close(failed)
+				})
+			}
+		}(page)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	if err := w.ctx.Err(); err != nil {
+		return err
+	}
+	if truncated {
+		return w.truncated(basePath, pages)
+	}
+	return nil
+}
+
+// truncated reports a collection cut short by the default max pages, the
+// job fails so an incomplete collection isn't taken for the whole one
+func (w *WorkUnit) truncated(basePath string, pages int) error {
+	err := fmt.Errorf("Stopped fetching %s after %d pages, set max_pages to fetch more pages", basePath, pages)
+	w.sendError(taskerror.Data, err.Error())
+	w.glog.Errorf("Error %v", err)
+	return err
+}
+
+// recoverPanic turns a panic of a goroutine started by the job into a
+// task error returned in err
+func (w *WorkUnit) recoverPanic(err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	w.glog.Errorf("Recovered from panic %v\n%s", r, debug.Stack())
+	*err = fmt.Errorf("%v", r)
+	w.sendError(taskerror.Panic, (*err).Error())
+}
 
-	err = w.requestAllRelations(jsonBody)
+// getNumberedPage fetches a page by setting the page query parameter
+func (w *WorkUnit) getNumberedPage(basePath string, page int) error {
+	u := *w.parsedURL
+	values := u.Query()
+	values.Set("page", strconv.Itoa(page))
+	u.RawQuery = values.Encode()
+	body, _, err := w.fetchURL(&u)
+	if err != nil {
+		w.glog.Errorf("Get failed %v", err)
+		return err
+	}
+	filename := fmt.Sprintf("%s%d.json", w.input.PagePrefix, page)
+	jsonBody, err := w.writeResponse(body, filepath.Join(basePath, filename))
 	if err != nil {
 		w.glog.Errorf("Error %v", err)
 		return err
 	}
+	return w.requestAllRelations(jsonBody)
+}
 
-	if w.input.FetchAllPages {
-		nextPage := jsonBody["next"]
-		for page := 2; reflect.TypeOf(nextPage) == reflect.TypeOf("string"); page++ {
-			w.input.Params["page"] = strconv.Itoa(page)
-			body, _, err := w.getPage()
-			if err != nil {
-				w.glog.Errorf("Get failed %v", err)
-				return err
-			}
-			filename = fmt.Sprintf("%s%d.json", w.input.PagePrefix, page)
-			jsonBody, err := w.writeResponse(body, filepath.Join(w.parsedURL.Path, filename))
-			if err != nil {
-				w.glog.Errorf("Error %v", err)
-				return err
-			}
-			err = w.requestAllRelations(jsonBody)
-			if err != nil {
-				w.glog.Errorf("Error %v", err)
-				return err
-			}
-			nextPage = jsonBody["next"]
+// eachPage fetches all the pages of a collection starting at u and calls
+// fn with the body of every page
+func (w *WorkUnit) eachPage(u *url.URL, fn func(body []byte) error) error {
+	visited := make(map[string]bool)
+	for page := 1; ; page++ {
+		visited[u.String()] = true
+		body, _, err := w.fetchURL(u)
+		if err != nil {
+			return err
+		}
+		if err := fn(body); err != nil {
+			return err
+		}
+
+		next := nextLink(body)
+		if next == "" {
+			return nil
+		}
+		if page >= defaultMaxPages {
+			err := fmt.Errorf("Stopped fetching %s after %d pages", u.Path, page)
+			w.sendError(taskerror.Data, err.Error())
+			return err
+		}
+		u, err = w.resolve(next)
+		if err != nil {
+			return err
+		}
+		if visited[u.String()] {
+			err = fmt.Errorf("Pagination loop detected, %s was already fetched", next)
+			w.sendError(taskerror.Data, err.Error())
+			return err
 		}
 	}
-	return nil
+}
+
+// nextLink returns the link to the next page from the unfiltered body
+func nextLink(body []byte) string {
+	var page struct {
+		Next interface{} `json:"next"`
+	}
+	if err := json.Unmarshal(body, &page); err != nil {
+		return ""
+	}
+	next, _ := page.Next.(string)
+	return next
+}
+
+// resolve turns a link returned by Tower into an URL on the Tower host
+func (w *WorkUnit) resolve(link string) (*url.URL, error) {
+	ref, err := url.Parse(link)
+	if err != nil {
+		return nil, err
+	}
+	u := w.hostURL.ResolveReference(ref)
+	u.Scheme = w.hostURL.Scheme
+	u.Host = w.hostURL.Host
+	return u, nil
 }
 
 func (w *WorkUnit) requestAllRelations(jsonBody map[string]interface{}) error {
@@ -372,25 +727,100 @@ func (w *WorkUnit) requestAllRelations(jsonBody map[string]interface{}) error {
 	return nil
 }
 
+// maxRelatedDepth stops following nested fetch_related
+const maxRelatedDepth = 5
+
+// requestRelated dispatches a job for the related attribute of every
+// object in the results or of the object itself that matches the predicate
 func (w *WorkUnit) requestRelated(jsonBody map[string]interface{}, related RelatedObject) error {
+	var predicate *filters.Predicate
+	if related.predicate != "" {
+		var err error
+		predicate, err = filters.NewPredicate(related.predicate)
+		if err != nil {
+			err = fmt.Errorf("Invalid predicate %s %v", related.predicate, err)
+			w.sendError(taskerror.Validation, err.Error())
+			w.glog.Errorf("Error %v", err)
+			return err
+		}
+	}
+
+	objects := []interface{}{jsonBody}
 	if val, ok := jsonBody["results"]; ok {
-		for _, o := range val.([]interface{}) {
-			obj := o.(map[string]interface{})
-			if enabled, found := obj[related.predicate]; found {
-				if !enabled.(bool) {
-					continue
-				}
+		objects, _ = val.([]interface{})
+	}
+	for _, o := range objects {
+		obj, ok := o.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if predicate != nil {
+			selected, err := predicate.Match(obj)
+			if err != nil {
+				err = fmt.Errorf("Error evaluating predicate %s %v", related.predicate, err)
+				w.sendError(taskerror.Validation, err.Error())
+				w.glog.Errorf("Error %v", err)
+				return err
 			}
-			if rel, found := obj[related.relAttribute]; found {
-				url := rel.(string)
-				w.dispatchChannel <- JobParam{Method: "GET", HrefSlug: url, ApplyFilter: related.jobExtra.ApplyFilter}
+			if !selected {
+				continue
 			}
-
+		}
+		href := relatedHref(obj, related.relAttribute)
+		if href == "" {
+			continue
+		}
+		if err := w.fetchRelated(href, related); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
+// relatedHref looks for the link in the attribute of the object and then
+// in the related map of Tower
+func relatedHref(obj map[string]interface{}, attribute string) string {
+	if href, ok := obj[attribute].(string); ok {
+		return href
+	}
+	links, _ := obj["related"].(map[string]interface{})
+	href, _ := links[attribute].(string)
+	return href
+}
+
+// fetchRelated dispatches a job for the related object unless the task
+// already fetched it with the same options
+func (w *WorkUnit) fetchRelated(href string, related RelatedObject) error {
+	depth := w.input.relatedDepth + 1
+	if depth > maxRelatedDepth {
+		err := fmt.Errorf("Stopped fetching %s, related objects are nested more than %d levels", href, maxRelatedDepth)
+		w.sendError(taskerror.Validation, err.Error())
+		w.glog.Errorf("Error %v", err)
+		return err
+	}
+	u, err := w.resolve(href)
+	if err != nil {
+		w.glog.Errorf("Error %v", err)
+		return err
+	}
+	// The same URL is fetched again with another filter or other nested
+	// relations
+	spec, err := json.Marshal(related.jobExtra)
+	if err != nil {
+		w.glog.Errorf("Error %v", err)
+		return err
+	}
+	if !w.task.firstFetch(u.String() + " " + string(spec)) {
+		w.glog.Infof("Skipping %s, it was already fetched", href)
+		return nil
+	}
+	job := related.jobExtra
+	job.Method = "GET"
+	job.HrefSlug = href
+	job.relatedDepth = depth
+	return w.dispatchJob(job)
+}
+
 func (w *WorkUnit) monitor() error {
 
 	var completedStatus = []string{"successful", "failed", "error", "canceled"}
@@ -400,6 +830,26 @@ func (w *WorkUnit) monitor() error {
 	if w.input.RefreshIntervalSeconds == 0 {
 		w.input.RefreshIntervalSeconds = 10
 	}
+	stream, err := w.newOutputStream()
+	if err != nil {
+		w.sendError(taskerror.Validation, err.Error())
+		w.glog.Errorf("Error %v", err)
+		return err
+	}
+	w.task.addTowerJob(w.input.HrefSlug)
+	defer w.task.removeTowerJob(w.input.HrefSlug)
+
+	var watcher *statusWatcher
+	if strings.ToLower(w.input.MonitorMode) == "websocket" {
+		watcher, err = w.watchStatus()
+		if err != nil {
+			w.glog.Infof("Tower websocket unavailable, polling %s instead %v", w.input.HrefSlug, err)
+			watcher = nil
+		}
+		defer watcher.close()
+	}
+	interval := time.Duration(w.input.RefreshIntervalSeconds) * time.Second
+	var approvals []PendingApproval
 	for {
 		body, _, err = w.getPage()
 		if err != nil {
@@ -413,30 +863,62 @@ func (w *WorkUnit) monitor() error {
 			return err
 		}
 
-		v, ok := jsonBody["status"]
+		status, ok := jsonBody["status"].(string)
 		if !ok {
 			err = errors.New("Object does not contain a status attribute")
-			w.sendError(err.Error(), 0)
+			w.sendError(taskerror.Data, err.Error())
 			w.glog.Errorf("Error %v", err)
 			return err
 		}
 
-		status := v.(string)
 		if !includes(status, allKnownStatus) {
 			err = errors.New("Status: " + status + " is not one of the known status")
-			w.sendError(err.Error(), 0)
+			w.sendError(taskerror.Data, err.Error())
 			w.glog.Errorf("Error %v", err)
 			return err
 		}
 
+		if stream != nil {
+			w.streamOutput(stream, includes(status, completedStatus))
+		}
+
 		if includes(status, completedStatus) {
 			break
-		} else {
-			time.Sleep(time.Duration(w.input.RefreshIntervalSeconds) * time.Second)
+		}
+
+		if isWorkflowJob(body) {
+			pending, err := w.pendingApprovals(body)
+			if err != nil {
+				w.glog.Errorf("Error collecting workflow approvals %v", err)
+				return err
+			}
+			if !sameApprovals(pending, approvals) {
+				approvals = pending
+				w.sendProgress(Progress{HrefSlug: w.input.HrefSlug, Approvals: approvals})
+			}
+		}
+		if err := watcher.wait(w.ctx, jobID(body), interval); err != nil {
+			w.glog.Infof("Monitoring %s stopped %v", w.parsedURL.String(), err)
+			return err
 		}
 	}
 
-	_, err = w.writeResponse(body, filepath.Join(w.parsedURL.Path, "response.json"))
+	jsonBody, err := w.createJSON(body)
+	if err != nil {
+		w.glog.Errorf("create JSON failed %v", err)
+		return err
+	}
+
+	if isWorkflowJob(body) {
+		nodes, err := w.workflowNodes(body)
+		if err != nil {
+			w.glog.Errorf("Error collecting workflow nodes %v", err)
+			return err
+		}
+		jsonBody["workflow_nodes"] = nodes
+	}
+
+	err = w.writePage(jsonBody, filepath.Join(w.parsedURL.Path, "response.json"))
 	if err != nil {
 		w.glog.Errorf("Error %v", err)
 		return err
@@ -445,6 +927,15 @@ func (w *WorkUnit) monitor() error {
 	return nil
 }
 
+// jobID returns the id from the unfiltered body of a job
+func jobID(body []byte) int64 {
+	var job struct {
+		ID int64 `json:"id"`
+	}
+	json.Unmarshal(body, &job)
+	return job.ID
+}
+
 func includes(s string, values []string) bool {
 	for _, v := range values {
 		if v == s {
@@ -456,6 +947,10 @@ func includes(s string, values []string) bool {
 
 func (w *WorkUnit) createJSON(body []byte) (map[string]interface{}, error) {
 	var jsonBody map[string]interface{}
+	// 204 No Content and some DELETE responses don't have a body
+	if len(bytes.TrimSpace(body)) == 0 {
+		return make(map[string]interface{}), nil
+	}
 	decoder := json.NewDecoder(bytes.NewReader(body))
 	decoder.UseNumber()
 	err := decoder.Decode(&jsonBody)
@@ -474,7 +969,14 @@ func (w *WorkUnit) createJSON(body []byte) (map[string]interface{}, error) {
 
 	v, ok := jsonBody["artifacts"]
 	if ok && v != nil {
-		s, err := artifacts.Sanctify(v.(map[string]interface{}))
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			err := fmt.Errorf("Invalid artifacts %v", v)
+			w.sendError(taskerror.Data, err.Error())
+			w.glog.Errorf("Error %v", err)
+			return nil, err
+		}
+		s, err := artifacts.Sanctify(m)
 		if err != nil {
 			w.glog.Errorf("Error %v", err)
 			return nil, err
@@ -490,14 +992,42 @@ func (w *WorkUnit) writePage(jsonBody map[string]interface{}, fileName string) e
 		w.glog.Errorf("Error %v", err)
 		return err
 	}
-	w.responseChannel <- Page{Name: fileName, Data: b}
-	return nil
+	select {
+	case w.responseChannel <- Page{Name: fileName, Data: b, job: w.input.id}:
+		return nil
+	case <-w.ctx.Done():
+		return w.ctx.Err()
+	}
 }
 
-func (w *WorkUnit) sendError(message string, httpStatus int) error {
-	s := fmt.Sprintf("URL : %s Status: %d Message: %s", w.input.HrefSlug, httpStatus, message)
-	w.errorChannel <- s
-	return nil
+// dispatchJob hands a follow up job to the dispatcher unless the task
+// has been canceled
+func (w *WorkUnit) dispatchJob(job JobParam) error {
+	select {
+	case w.dispatchChannel <- job:
+		return nil
+	case <-w.ctx.Done():
+		return w.ctx.Err()
+	}
+}
+
+// sendError reports a failure of the job as a task error
+func (w *WorkUnit) sendError(category string, message string) error {
+	return w.reportError(&taskerror.Error{Category: category, Message: message})
+}
+
+// reportError adds the job to the error and sends it to the task
+func (w *WorkUnit) reportError(e *taskerror.Error) error {
+	e.Job = w.input.HrefSlug
+	e.Method = w.input.Method
+	e.JobID = w.input.id
+	atomic.StoreInt32(&w.errorSent, 1)
+	select {
+	case w.errorChannel <- e:
+		return nil
+	case <-w.ctx.Done():
+		return w.ctx.Err()
+	}
 }
 
 func successHTTPCode(code int) bool {
@@ -1,7 +1,23 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/mkanoor/catalog_mqtt_client/internal/taskerror"
+	"golang.org/x/net/websocket"
 )
 
 func TestGet(t *testing.T) {
@@ -109,3 +125,887 @@ func TestUnknownMethod(t *testing.T) {
 	ts := &testScaffold{}
 	ts.runFail(t, jp, 200, responseBody, "Invalid method received unknown")
 }
+
+func TestMonitorCanceled(t *testing.T) {
+	responseBody := []string{`{"name": "job15", "id": 15, "url": "url15","status":"running"}`}
+	jp := JobParam{
+		Method:                 "monitor",
+		HrefSlug:               "/api/v2/jobs/15",
+		RefreshIntervalSeconds: 60,
+	}
+	ts := &testScaffold{}
+	ts.base(t, jp, 200, responseBody)
+	ctx, cancel := context.WithTimeout(testContext(), 50*time.Millisecond)
+	defer cancel()
+	apiw := &DefaultAPIWorker{}
+	err := apiw.StartWork(ctx, ts.config, jp, ts.client, ts.wc)
+	ts.stop()
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Monitor should have been canceled, got %v", err)
+	}
+}
+
+func TestGetRetry(t *testing.T) {
+	responseBody := []string{"Unavailable", "Too many requests", `{"name": "jt1", "id": 1}`}
+	jp := JobParam{Method: "get", HrefSlug: "/api/v2/job_templates/1"}
+	ts := &testScaffold{}
+	err := ts.runRetry(t, jp, []int{503, 429, 200}, nil, responseBody)
+	if err != nil {
+		t.Fatalf("Get should have been retried %v", err)
+	}
+	if len(ts.pages) != 1 || len(ts.errors) != 0 {
+		t.Fatalf("Expected 1 page and no errors got %d pages %v", len(ts.pages), ts.errors)
+	}
+}
+
+func TestGetRetryExhausted(t *testing.T) {
+	responseBody := []string{"Unavailable", "Unavailable", "Unavailable"}
+	jp := JobParam{Method: "get", HrefSlug: "/api/v2/job_templates/1"}
+	ts := &testScaffold{}
+	err := ts.runRetry(t, jp, []int{503, 503, 503}, nil, responseBody)
+	if err == nil || ts.client.Transport.(*fakeTransport).requestNumber != 3 {
+		t.Fatalf("Get should have failed after 3 attempts")
+	}
+}
+
+func TestGetNotRetryable(t *testing.T) {
+	responseBody := []string{"Not Found"}
+	jp := JobParam{Method: "get", HrefSlug: "/api/v2/job_templates/1"}
+	ts := &testScaffold{}
+	err := ts.runRetry(t, jp, []int{404}, nil, responseBody)
+	if err == nil || ts.client.Transport.(*fakeTransport).requestNumber != 1 {
+		t.Fatalf("Get should have failed without retrying")
+	}
+}
+
+func TestPostNotRetriedOnStatus(t *testing.T) {
+	responseBody := []string{"Unavailable", `{"name": "job1", "id": 1}`}
+	jp := JobParam{Method: "post", HrefSlug: "/api/v2/job_templates/5/launch"}
+	ts := &testScaffold{}
+	err := ts.runRetry(t, jp, []int{503, 200}, nil, responseBody)
+	if err == nil || ts.client.Transport.(*fakeTransport).requestNumber != 1 {
+		t.Fatalf("Post should not be retried after it was sent")
+	}
+}
+
+func TestPostRetriedOnDialError(t *testing.T) {
+	responseBody := []string{"", `{"name": "job1", "id": 1}`}
+	dialErr := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	jp := JobParam{Method: "post", HrefSlug: "/api/v2/job_templates/5/launch"}
+	ts := &testScaffold{}
+	err := ts.runRetry(t, jp, nil, []error{dialErr}, responseBody)
+	if err != nil {
+		t.Fatalf("Post should have been retried after a dial error %v", err)
+	}
+	if len(ts.pages) != 1 {
+		t.Fatalf("Expected 1 page got %d", len(ts.pages))
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	resp := &http.Response{Header: http.Header{"Retry-After": {"7"}}}
+	if d := retryAfter(resp); d != 7*time.Second {
+		t.Errorf("Expected 7s got %v", d)
+	}
+	resp.Header.Set("Retry-After", time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	if d := retryAfter(resp); d < 50*time.Second || d > time.Minute {
+		t.Errorf("Expected about a minute got %v", d)
+	}
+	if d := retryAfter(nil); d != 0 {
+		t.Errorf("Expected no delay got %v", d)
+	}
+}
+
+func TestRetryAfterClamped(t *testing.T) {
+	responseBody := []string{"Too many requests", `{"name": "jt1", "id": 1}`}
+	jp := JobParam{Method: "get", HrefSlug: "/api/v2/job_templates/1"}
+	ts := &testScaffold{}
+	ts.base(t, jp, 200, responseBody)
+	tr := ts.client.Transport.(*fakeTransport)
+	tr.statuses = []int{429, 200}
+	tr.header = http.Header{"Retry-After": {"3600"}}
+	ts.config.RetryMaxAttempts = 2
+	ts.config.RetryMaxInterval = 10 * time.Millisecond
+	ts.config.RetryStatusCodes = StatusCodes{429}
+	start := time.Now()
+	err := (&DefaultAPIWorker{}).StartWork(testContext(), ts.config, jp, ts.client, ts.wc)
+	ts.stop()
+	if err != nil {
+		t.Fatalf("StartWork failed %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("Retry-After should be limited by retry_max_interval, took %v", time.Since(start))
+	}
+}
+
+func TestRetryAfterDeadline(t *testing.T) {
+	responseBody := []string{"Too many requests", `{"name": "jt1", "id": 1}`}
+	jp := JobParam{Method: "get", HrefSlug: "/api/v2/job_templates/1"}
+	ts := &testScaffold{}
+	ts.base(t, jp, 200, responseBody)
+	tr := ts.client.Transport.(*fakeTransport)
+	tr.statuses = []int{429, 200}
+	tr.header = http.Header{"Retry-After": {"3600"}}
+	ts.config.RetryMaxAttempts = 2
+	ts.config.RetryMaxInterval = time.Hour
+	ts.config.RetryStatusCodes = StatusCodes{429}
+	ctx, cancel := context.WithTimeout(testContext(), time.Minute)
+	defer cancel()
+	start := time.Now()
+	err := (&DefaultAPIWorker{}).StartWork(ctx, ts.config, jp, ts.client, ts.wc)
+	ts.stop()
+	if err == nil || len(ts.errors) != 1 || ts.errors[0].Status != 429 {
+		t.Fatalf("Expected the 429 to be reported got %v %v", err, ts.errors)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("A retry after the task deadline should not be waited for, took %v", time.Since(start))
+	}
+}
+
+func TestRateLimitSlowdown(t *testing.T) {
+	responseBody := []string{"Too many requests", `{"name": "jt1", "id": 1}`}
+	jp := JobParam{Method: "get", HrefSlug: "/api/v2/job_templates/1"}
+	ts := &testScaffold{}
+	ts.base(t, jp, 200, responseBody)
+	ts.client.Transport.(*fakeTransport).statuses = []int{429, 200}
+	ts.config.RetryMaxAttempts = 2
+	ts.config.RetryStatusCodes = StatusCodes{429}
+	ts.config.TowerRequestsPerSecond = 100
+	ts.config.TowerBurst = 1
+	apiw, _ := MakeDefaultAPIWorker(ts.config)
+	err := apiw.StartWork(testContext(), ts.config, jp, ts.client, ts.wc)
+	ts.stop()
+	if err != nil {
+		t.Fatalf("StartWork failed %v", err)
+	}
+	if rate := apiw.limiter.Rate(); rate != 60 {
+		t.Fatalf("Rate should have been halved on 429 and raised on success, got %v", rate)
+	}
+}
+
+func TestGetFollowsNext(t *testing.T) {
+	responseBody := []string{`{"count": 3, "next": "/api/v2/hosts/?cursor=abc", "results": [{"id": 1}]}`,
+		`{"count": 3, "next": "https://other.example.com/api/v2/hosts/?cursor=def", "results": [{"id": 2}]}`,
+		`{"count": 3, "next": null, "results": [{"id": 3}]}`}
+	jp := JobParam{Method: "get", HrefSlug: "/api/v2/hosts/?page_size=1", FetchAllPages: true}
+	ts := &testScaffold{}
+	ts.runSuccess(t, jp, 200, responseBody, []map[string]interface{}{{"count": 3}, {"count": 3}, {"count": 3}})
+
+	urls := ts.client.Transport.(*fakeTransport).urls
+	expected := []string{"https://192.1.1.1/api/v2/hosts/?page_size=1",
+		"https://192.1.1.1/api/v2/hosts/?cursor=abc",
+		"https://192.1.1.1/api/v2/hosts/?cursor=def"}
+	for i, u := range expected {
+		if urls[i] != u {
+			t.Errorf("Expected request %d to %s got %s", i, u, urls[i])
+		}
+	}
+	if ts.pages[2].Name != "/api/v2/hosts/page3.json" {
+		t.Errorf("Unexpected page name %s", ts.pages[2].Name)
+	}
+}
+
+func TestGetMaxPages(t *testing.T) {
+	responseBody := []string{`{"count": 3, "next": "/api/v2/hosts/?page=2", "results": []}`,
+		`{"count": 3, "next": "/api/v2/hosts/?page=3", "results": []}`}
+	jp := JobParam{Method: "get", HrefSlug: "/api/v2/hosts/", FetchAllPages: true, MaxPages: 2}
+	ts := &testScaffold{}
+	ts.runSuccess(t, jp, 200, responseBody, []map[string]interface{}{{"count": 3}, {"count": 3}})
+}
+
+func TestGetPaginationLoop(t *testing.T) {
+	responseBody := []string{`{"count": 3, "next": "/api/v2/hosts/?page=2", "results": []}`,
+		`{"count": 3, "next": "/api/v2/hosts/?page=2", "results": []}`}
+	jp := JobParam{Method: "get", HrefSlug: "/api/v2/hosts/", FetchAllPages: true}
+	ts := &testScaffold{}
+	ts.runFail(t, jp, 200, responseBody, "Pagination loop detected")
+}
+
+// pageTransport serves a collection of 5 hosts with a page size of 1 and
+// keeps track of the number of requests running at the same time
+type pageTransport struct {
+	mu         sync.Mutex
+	running    int
+	maxRunning int
+	failFrom   int // the pages from failFrom on fail with a 500
+	panicPage  int // the request of panicPage panics
+}
+
+func (pt *pageTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	pt.mu.Lock()
+	pt.running++
+	if pt.running > pt.maxRunning {
+		pt.maxRunning = pt.running
+	}
+	pt.mu.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	defer func() {
+		pt.mu.Lock()
+		pt.running--
+		pt.mu.Unlock()
+	}()
+
+	page, err := strconv.Atoi(req.URL.Query().Get("page"))
+	if err != nil {
+		page = 1
+	}
+	if page == pt.panicPage {
+		panic("unexpected page")
+	}
+	if pt.failFrom > 0 && page >= pt.failFrom {
+		return &http.Response{
+			StatusCode: 500,
+			Status:     "500 Internal Server Error",
+			Body:       ioutil.NopCloser(strings.NewReader(`{"detail": "error"}`)),
+			Header:     http.Header{"Content-Type": {"application/json"}},
+		}, nil
+	}
+	next := "null"
+	if page < 5 {
+		next = fmt.Sprintf(`"/api/v2/hosts/?page=%d&page_size=1"`, page+1)
+	}
+	body := fmt.Sprintf(`{"count": 5, "next": %s, "results": [{"id": %d}]}`, next, page)
+	return &http.Response{
+		StatusCode: 200,
+		Status:     "200 OK",
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+		Header:     http.Header{"Content-Type": {"application/json"}},
+	}, nil
+}
+
+func TestGetParallelPages(t *testing.T) {
+	collect := func(parallel int) (map[string]string, int) {
+		jp := JobParam{Method: "get", HrefSlug: "/api/v2/hosts/?page_size=1", FetchAllPages: true, ParallelPages: parallel}
+		ts := &testScaffold{}
+		ts.base(t, jp, 200, nil)
+		pt := &pageTransport{}
+		ts.client = &http.Client{Transport: pt}
+		err := (&DefaultAPIWorker{}).StartWork(testContext(), ts.config, jp, ts.client, ts.wc)
+		ts.stop()
+		if err != nil {
+			t.Fatalf("StartWork failed %v", err)
+		}
+		pages := make(map[string]string)
+		for _, p := range ts.pages {
+			pages[p.Name] = string(p.Data)
+		}
+		return pages, pt.maxRunning
+	}
+
+	sequential, _ := collect(0)
+	parallel, maxRunning := collect(2)
+	if len(parallel) != 5 || !reflect.DeepEqual(sequential, parallel) {
+		t.Fatalf("Parallel pages %v don't match sequential pages %v", parallel, sequential)
+	}
+	if maxRunning > 2 {
+		t.Fatalf("At most 2 pages should be fetched at once, %d were", maxRunning)
+	}
+}
+
+func runParallelPages(t *testing.T, pt *pageTransport) *testScaffold {
+	jp := JobParam{Method: "get", HrefSlug: "/api/v2/hosts/?page_size=1", FetchAllPages: true, ParallelPages: 4}
+	ts := &testScaffold{}
+	ts.base(t, jp, 200, nil)
+	ts.client = &http.Client{Transport: pt}
+	err := (&DefaultAPIWorker{}).StartWork(testContext(), ts.config, jp, ts.client, ts.wc)
+	ts.stop()
+	if err == nil {
+		t.Fatalf("StartWork should have failed")
+	}
+	return ts
+}
+
+func TestGetParallelPagesFail(t *testing.T) {
+	ts := runParallelPages(t, &pageTransport{failFrom: 2})
+	if len(ts.errors) == 0 {
+		t.Fatalf("The failed pages were not reported")
+	}
+	for _, e := range ts.errors {
+		if e.Category != taskerror.Tower || e.Status != 500 {
+			t.Errorf("Unexpected error %+v", e)
+		}
+	}
+}
+
+func TestGetParallelPagesPanic(t *testing.T) {
+	ts := runParallelPages(t, &pageTransport{panicPage: 3})
+	if len(ts.errors) != 1 || ts.errors[0].Category != taskerror.Panic || ts.errors[0].Message != "unexpected page" {
+		t.Fatalf("Expected the panic to be reported got %v", ts.errors)
+	}
+}
+
+// endlessTransport serves a collection with more pages than the default
+// max pages
+type endlessTransport struct{}
+
+func (et *endlessTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	page, err := strconv.Atoi(req.URL.Query().Get("page"))
+	if err != nil {
+		page = 1
+	}
+	body := fmt.Sprintf(`{"count": 5000, "next": "/api/v2/hosts/?page=%d&page_size=1", "results": [{"id": %d}]}`, page+1, page)
+	return &http.Response{
+		StatusCode: 200,
+		Status:     "200 OK",
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+		Header:     http.Header{"Content-Type": {"application/json"}},
+	}, nil
+}
+
+func TestGetDefaultMaxPages(t *testing.T) {
+	store, cleanup := openTestStore(t)
+	defer cleanup()
+	for _, parallel := range []int{0, 4} {
+		jp := JobParam{Method: "get", HrefSlug: "/api/v2/hosts/?page_size=1", FetchAllPages: true, ParallelPages: parallel, ModifiedSince: true}
+		ts := &testScaffold{}
+		ts.base(t, jp, 200, nil)
+		ts.client = &http.Client{Transport: &endlessTransport{}}
+		err := (&DefaultAPIWorker{syncStore: store}).StartWork(testContext(), ts.config, jp, ts.client, ts.wc)
+		ts.stop()
+		if err == nil || len(ts.errors) != 1 || !strings.Contains(ts.errors[0].Message, "max_pages") {
+			t.Fatalf("The truncated collection should have been reported got %v %v", err, ts.errors)
+		}
+		if len(ts.pages) != defaultMaxPages {
+			t.Errorf("Expected %d pages got %d", defaultMaxPages, len(ts.pages))
+		}
+		if _, ok := store.Get(jp.HrefSlug); ok {
+			t.Errorf("The sync state of a truncated collection should not be saved")
+		}
+	}
+}
+
+func TestPut(t *testing.T) {
+	responseBody := []string{`{"name": "Survey", "spec": []}`}
+	jp := JobParam{
+		Method:   "put",
+		HrefSlug: "/api/v2/job_templates/5/survey_spec/",
+		Params:   map[string]interface{}{"name": "Survey", "spec": []interface{}{}},
+	}
+	ts := &testScaffold{}
+	ts.runSuccess(t, jp, 200, responseBody, []map[string]interface{}{{"name": "Survey"}})
+	if ts.pages[0].Name != "/api/v2/job_templates/5/survey_spec/response.json" {
+		t.Fatalf("Unexpected page name %s", ts.pages[0].Name)
+	}
+}
+
+func TestPatch(t *testing.T) {
+	responseBody := []string{`{"name": "inventory1", "id": 9}`}
+	jp := JobParam{Method: "patch", HrefSlug: "/api/v2/inventories/9/", Params: map[string]interface{}{"name": "inventory1"}}
+	ts := &testScaffold{}
+	ts.runSuccess(t, jp, 200, responseBody, []map[string]interface{}{{"name": "inventory1", "id": 9}})
+}
+
+func TestDeleteNoContent(t *testing.T) {
+	jp := JobParam{Method: "delete", HrefSlug: "/api/v2/inventories/9/"}
+	ts := &testScaffold{}
+	ts.runSuccess(t, jp, 204, []string{""}, []map[string]interface{}{{}})
+	if string(ts.pages[0].Data) != "{}" {
+		t.Fatalf("Expected an empty object for 204 got %s", string(ts.pages[0].Data))
+	}
+}
+
+func TestUnexpectedStatus(t *testing.T) {
+	jp := JobParam{Method: "delete", HrefSlug: "/api/v2/inventories/9/", ExpectedStatus: []int{204}}
+	ts := &testScaffold{}
+	ts.runFail(t, jp, 200, []string{`{"detail": "queued"}`}, "queued")
+}
+
+func TestMonitorWorkflow(t *testing.T) {
+	responseBody := []string{
+		`{"id": 20, "type": "workflow_job", "status": "failed", "related": {"workflow_nodes": "/api/v2/workflow_jobs/20/workflow_nodes/"}}`,
+		`{"count": 2, "next": null, "results": [
+			{"id": 1, "identifier": "provision", "job": 21, "related": {"job": "/api/v2/jobs/21/"}, "summary_fields": {"job": {"name": "provision", "status": "failed", "failed": true, "type": "job"}}},
+			{"id": 2, "identifier": "notify", "job": null, "related": {}, "summary_fields": {}}]}`,
+		`{"id": 21, "name": "provision", "status": "failed", "failed": true, "artifacts": {"expose_to_cloud_redhat_com_vm": "vm1", "secret": "abc"}}`,
+	}
+	jp := JobParam{Method: "monitor", HrefSlug: "/api/v2/workflow_jobs/20/"}
+	ts := &testScaffold{}
+	ts.runSuccess(t, jp, 200, responseBody, []map[string]interface{}{{"status": "failed", "workflow_nodes": []interface{}{}}})
+
+	var result struct {
+		WorkflowNodes []WorkflowNodeStatus `json:"workflow_nodes"`
+	}
+	if err := json.Unmarshal(ts.pages[0].Data, &result); err != nil {
+		t.Fatalf("Error decoding response %v", err)
+	}
+	nodes := result.WorkflowNodes
+	if len(nodes) != 2 {
+		t.Fatalf("Expected 2 workflow nodes got %d", len(nodes))
+	}
+	if nodes[0].JobID != 21 || nodes[0].Status != "failed" || !nodes[0].Failed || nodes[0].Identifier != "provision" {
+		t.Errorf("Unexpected status for the first node %+v", nodes[0])
+	}
+	if nodes[0].Artifacts["expose_to_cloud_redhat_com_vm"] != "vm1" || nodes[0].Artifacts["secret"] != nil {
+		t.Errorf("Artifacts were not sanctified %v", nodes[0].Artifacts)
+	}
+	if nodes[1].Status != "never_run" {
+		t.Errorf("Node without a job should not have run %+v", nodes[1])
+	}
+	urls := ts.client.Transport.(*fakeTransport).urls
+	if urls[1] != "https://192.1.1.1/api/v2/workflow_jobs/20/workflow_nodes/" || urls[2] != "https://192.1.1.1/api/v2/jobs/21/" {
+		t.Errorf("Unexpected requests %v", urls)
+	}
+}
+
+func TestMonitorStreamEvents(t *testing.T) {
+	responseBody := []string{`{"id": 15, "status": "running"}`,
+		`{"count": 2, "next": null, "results": [{"counter": 1, "event": "playbook_on_start", "stdout": "", "uuid": "a"},
+			{"counter": 2, "event": "runner_on_ok", "stdout": "ok: [host1] password=hunter2 vm=vm-123", "uuid": "b"}]}`,
+		`{"id": 15, "status": "successful"}`,
+		`{"count": 1, "next": null, "results": [{"counter": 3, "event": "playbook_on_stats", "stdout": "PLAY RECAP"}]}`}
+	jp := JobParam{
+		Method:                 "monitor",
+		HrefSlug:               "/api/v2/jobs/15/",
+		RefreshIntervalSeconds: 1,
+		StreamOutput:           "events",
+		Redact:                 []string{`vm-\d+`},
+	}
+	ts := &testScaffold{}
+	ts.runSuccess(t, jp, 200, responseBody, []map[string]interface{}{{"status": "successful"}})
+
+	if len(ts.progress) != 2 || len(ts.progress[0].Events) != 2 || len(ts.progress[1].Events) != 1 {
+		t.Fatalf("Expected 2 progress updates with 2 and 1 events got %v", ts.progress)
+	}
+	stdout := ts.progress[0].Events[1]["stdout"]
+	if stdout != "ok: [host1] password=******** vm=********" {
+		t.Errorf("Output was not redacted %v", stdout)
+	}
+	if _, ok := ts.progress[0].Events[1]["uuid"]; ok {
+		t.Errorf("Only the known event attributes should be sent")
+	}
+	urls := ts.client.Transport.(*fakeTransport).urls
+	if !strings.Contains(urls[3], "/api/v2/jobs/15/job_events/?counter__gt=2") {
+		t.Errorf("Events should be fetched after the last counter got %s", urls[3])
+	}
+}
+
+func TestMonitorStreamEventsPages(t *testing.T) {
+	responseBody := []string{`{"id": 15, "status": "successful"}`,
+		`{"count": 3, "next": "/api/v2/jobs/15/job_events/?page=2", "results": [{"counter": 1, "event": "playbook_on_start"}, {"counter": 2, "event": "runner_on_ok"}]}`,
+		`{"count": 1, "next": null, "results": [{"counter": 3, "event": "playbook_on_stats"}]}`}
+	jp := JobParam{Method: "monitor", HrefSlug: "/api/v2/jobs/15/", StreamOutput: "events"}
+	ts := &testScaffold{}
+	ts.runSuccess(t, jp, 200, responseBody, []map[string]interface{}{{"status": "successful"}})
+	if len(ts.progress) != 2 || len(ts.progress[0].Events) != 2 || !ts.progress[0].Truncated ||
+		len(ts.progress[1].Events) != 1 || ts.progress[1].Truncated {
+		t.Fatalf("Expected the events of the finished job in 2 updates got %v", ts.progress)
+	}
+	if urls := ts.client.Transport.(*fakeTransport).urls; !strings.Contains(urls[2], "counter__gt=2") {
+		t.Errorf("Events should be fetched after the last counter got %s", urls[2])
+	}
+}
+
+func TestMonitorStreamStdout(t *testing.T) {
+	responseBody := []string{`{"id": 15, "status": "successful"}`, "0123456789abcdef"}
+	jp := JobParam{
+		Method:         "monitor",
+		HrefSlug:       "/api/v2/jobs/15/",
+		StreamOutput:   "stdout",
+		StreamMaxBytes: 10,
+	}
+	ts := &testScaffold{}
+	ts.runSuccess(t, jp, 200, responseBody, []map[string]interface{}{{"status": "successful"}})
+	// The job finished, the rest of the output is sent right away
+	if len(ts.progress) != 2 || ts.progress[0].Stdout != "0123456789" || !ts.progress[0].Truncated ||
+		ts.progress[1].Stdout != "abcdef" || ts.progress[1].Truncated {
+		t.Fatalf("Expected the stdout in 2 updates got %v", ts.progress)
+	}
+	if urls := ts.client.Transport.(*fakeTransport).urls; urls[1] != "https://192.1.1.1/api/v2/jobs/15/stdout/?format=txt" {
+		t.Errorf("Unexpected stdout request %s", urls[1])
+	}
+}
+
+func TestMonitorStreamStdoutLines(t *testing.T) {
+	responseBody := []string{`{"id": 15, "status": "running"}`, "ok: [host1]\npassword: hun",
+		`{"id": 15, "status": "successful"}`, "ok: [host1]\npassword: hunter2\nvm: éé"}
+	jp := JobParam{
+		Method:                 "monitor",
+		HrefSlug:               "/api/v2/jobs/15/",
+		RefreshIntervalSeconds: 1,
+		StreamOutput:           "stdout",
+		StreamMaxBytes:         24,
+	}
+	ts := &testScaffold{}
+	ts.runSuccess(t, jp, 200, responseBody, []map[string]interface{}{{"status": "successful"}})
+	if len(ts.progress) != 3 {
+		t.Fatalf("Expected 3 progress updates got %v", ts.progress)
+	}
+	if ts.progress[0].Stdout != "ok: [host1]\n" || ts.progress[0].Truncated {
+		t.Errorf("Only the complete lines should be sent got %q", ts.progress[0].Stdout)
+	}
+	if ts.progress[1].Stdout != "password: ********\n" || !ts.progress[1].Truncated {
+		t.Errorf("Expected the redacted output cut after the last line got %q", ts.progress[1].Stdout)
+	}
+	if ts.progress[2].Stdout != "vm: éé" || ts.progress[2].Truncated {
+		t.Errorf("Expected the rest of the output got %q", ts.progress[2].Stdout)
+	}
+}
+
+func TestCutText(t *testing.T) {
+	// A line longer than the max bytes is cut before the é across the limit
+	if cut := cutText("vm: éé", 7); cut != "vm: é" {
+		t.Errorf("Expected the text cut on a rune boundary got %q", cut)
+	}
+	if cut := cutText("é", 1); cut != "é" {
+		t.Errorf("Expected the first rune got %q", cut)
+	}
+}
+
+func TestMonitorStreamInvalid(t *testing.T) {
+	jp := JobParam{Method: "monitor", HrefSlug: "/api/v2/jobs/15/", StreamOutput: "logs"}
+	ts := &testScaffold{}
+	ts.runFail(t, jp, 200, []string{`{"id": 15, "status": "successful"}`}, "Invalid stream_output")
+}
+
+// fakeTowerWebsocket accepts the subscription and sends the status changes
+func fakeTowerWebsocket(t *testing.T, changes []string) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/websocket/", websocket.Handler(func(conn *websocket.Conn) {
+		if conn.Request().Header.Get("Authorization") != "Bearer 123" {
+			t.Errorf("Invalid websocket authorization %s", conn.Request().Header.Get("Authorization"))
+		}
+		websocket.JSON.Send(conn, map[string]interface{}{"accept": true, "user": 1})
+		var subscribe map[string]interface{}
+		websocket.JSON.Receive(conn, &subscribe)
+		if _, ok := subscribe["groups"]; !ok {
+			t.Errorf("Invalid subscription %v", subscribe)
+		}
+		for _, c := range changes {
+			websocket.Message.Send(conn, c)
+		}
+		var ignored string
+		websocket.Message.Receive(conn, &ignored)
+	}))
+	return httptest.NewServer(mux)
+}
+
+func runWebsocketMonitor(t *testing.T, towerURL string) (*testScaffold, time.Duration) {
+	responseBody := []string{`{"id": 15, "status": "running"}`, `{"id": 15, "status": "successful"}`}
+	jp := JobParam{Method: "monitor", HrefSlug: "/api/v2/jobs/15/", RefreshIntervalSeconds: 1, MonitorMode: "websocket"}
+	ts := &testScaffold{}
+	ts.base(t, jp, 200, responseBody)
+	ts.config.URL = towerURL
+	start := time.Now()
+	err := (&DefaultAPIWorker{}).StartWork(testContext(), ts.config, jp, ts.client, ts.wc)
+	ts.stop()
+	if err != nil {
+		t.Fatalf("StartWork failed %v", err)
+	}
+	if len(ts.pages) != 1 || ts.parsePayload(ts.pages[0].Data)["status"] != "successful" {
+		t.Fatalf("Expected the successful job got %v", ts.pages)
+	}
+	return ts, time.Since(start)
+}
+
+func TestMonitorWebsocket(t *testing.T) {
+	tower := fakeTowerWebsocket(t, []string{
+		`{"unified_job_id": 99, "status": "successful", "group_name": "jobs"}`,
+		`{"unified_job_id": 15, "status": "successful", "group_name": "jobs"}`})
+	defer tower.Close()
+	_, elapsed := runWebsocketMonitor(t, tower.URL)
+	if elapsed > 500*time.Millisecond {
+		t.Fatalf("The status change should have been noticed without polling, took %v", elapsed)
+	}
+}
+
+func TestMonitorWebsocketFallback(t *testing.T) {
+	tower := httptest.NewServer(http.NotFoundHandler())
+	defer tower.Close()
+	_, elapsed := runWebsocketMonitor(t, tower.URL)
+	if elapsed < time.Second {
+		t.Fatalf("Monitor should have fallen back to polling, took %v", elapsed)
+	}
+}
+
+func TestMonitorWorkflowApprovals(t *testing.T) {
+	responseBody := []string{
+		`{"id": 20, "type": "workflow_job", "status": "running", "related": {"workflow_nodes": "/api/v2/workflow_jobs/20/workflow_nodes/"}}`,
+		`{"count": 2, "next": null, "results": [
+			{"id": 1, "identifier": "provision", "job": 21, "related": {"job": "/api/v2/jobs/21/"}, "summary_fields": {"job": {"name": "provision", "status": "successful", "type": "job"}}},
+			{"id": 2, "identifier": "approve_vm", "job": 30, "related": {"job": "/api/v2/workflow_approvals/30/"}, "summary_fields": {"job": {"name": "Approve VM", "status": "pending", "type": "workflow_approval"}}}]}`,
+		`{"id": 20, "type": "workflow_job", "status": "successful", "related": {"workflow_nodes": "/api/v2/workflow_jobs/20/workflow_nodes/"}}`,
+		`{"count": 1, "next": null, "results": [
+			{"id": 2, "identifier": "approve_vm", "job": 30, "related": {"job": "/api/v2/workflow_approvals/30/"}, "summary_fields": {"job": {"name": "Approve VM", "status": "successful", "type": "workflow_approval"}}}]}`,
+		`{"id": 30, "name": "Approve VM", "status": "successful", "failed": false}`,
+	}
+	jp := JobParam{Method: "monitor", HrefSlug: "/api/v2/workflow_jobs/20/", RefreshIntervalSeconds: 1}
+	ts := &testScaffold{}
+	ts.runSuccess(t, jp, 200, responseBody, []map[string]interface{}{{"status": "successful", "workflow_nodes": []interface{}{}}})
+
+	if len(ts.progress) != 1 || len(ts.progress[0].Approvals) != 1 {
+		t.Fatalf("Expected a progress update with 1 approval got %v", ts.progress)
+	}
+	approval := ts.progress[0].Approvals[0]
+	if approval.ID != 30 || approval.NodeID != 2 || approval.Name != "Approve VM" || approval.HrefSlug != "/api/v2/workflow_approvals/30/" {
+		t.Errorf("Unexpected pending approval %+v", approval)
+	}
+}
+
+func TestApprove(t *testing.T) {
+	for _, method := range []string{"approve", "deny"} {
+		jp := JobParam{Method: method, HrefSlug: "/api/v2/workflow_approvals/30/"}
+		ts := &testScaffold{}
+		ts.runSuccess(t, jp, 204, []string{""}, []map[string]interface{}{{}})
+		urls := ts.client.Transport.(*fakeTransport).urls
+		if urls[0] != "https://192.1.1.1/api/v2/workflow_approvals/30/"+method+"/" {
+			t.Errorf("Unexpected request %v", urls)
+		}
+	}
+}
+
+func TestApproveDecided(t *testing.T) {
+	jp := JobParam{Method: "approve", HrefSlug: "/api/v2/workflow_approvals/30/"}
+	ts := &testScaffold{}
+	ts.runFail(t, jp, 400, []string{`{"error": "This workflow step has already been approved or denied."}`}, "already been approved")
+}
+
+const testLaunchInfo = `{"can_start_without_user_input": false, "passwords_needed_to_start": ["ssh_password"],
+	"ask_variables_on_launch": false, "ask_inventory_on_launch": true, "ask_credential_on_launch": true, "ask_limit_on_launch": false,
+	"survey_enabled": true, "variables_needed_to_start": ["vm_name", "size"], "credential_needed_to_start": true, "inventory_needed_to_start": false}`
+
+func TestLaunchPreflight(t *testing.T) {
+	responseBody := []string{testLaunchInfo, `{"id": 7, "url": "/api/v2/jobs/7/", "status": "pending"}`}
+	jp := JobParam{
+		Method:   "launch",
+		HrefSlug: "/api/v2/job_templates/5/launch/",
+		Params: map[string]interface{}{
+			"extra_vars":   "vm_name: vm1\nsize: small",
+			"credentials":  []interface{}{3},
+			"ssh_password": "secret",
+		},
+	}
+	ts := &testScaffold{}
+	ts.runSuccess(t, jp, 200, responseBody, []map[string]interface{}{{"id": 7}})
+	if len(ts.dispatched) != 1 || ts.dispatched[0].HrefSlug != "/api/v2/jobs/7/" {
+		t.Fatalf("The launched job should be monitored %v", ts.dispatched)
+	}
+}
+
+func TestLaunchPreflightMissing(t *testing.T) {
+	jp := JobParam{
+		Method:   "launch",
+		HrefSlug: "/api/v2/job_templates/5/launch/",
+		Params: map[string]interface{}{
+			"extra_vars": map[string]interface{}{"vm_name": "vm1"},
+			"limit":      "host1",
+		},
+	}
+	ts := &testScaffold{}
+	ts.runFail(t, jp, 200, []string{testLaunchInfo}, `"missing_variables":["size"]`)
+	if n := ts.client.Transport.(*fakeTransport).requestNumber; n != 1 {
+		t.Fatalf("The template should not have been launched, %d requests were sent", n)
+	}
+
+	lerr, ok := ts.errors[0].Body.(*LaunchError)
+	if !ok || ts.errors[0].Category != taskerror.Validation {
+		t.Fatalf("Expected a launch validation error got %+v", ts.errors[0])
+	}
+	if len(lerr.MissingPasswords) != 1 || lerr.MissingPasswords[0] != "ssh_password" {
+		t.Errorf("Expected the missing ssh_password got %v", lerr.MissingPasswords)
+	}
+	if len(lerr.MissingFields) != 1 || lerr.MissingFields[0] != "credentials" {
+		t.Errorf("Expected the missing credentials got %v", lerr.MissingFields)
+	}
+	if len(lerr.NotPrompted) != 1 || lerr.NotPrompted[0] != "limit" {
+		t.Errorf("Expected limit to be not prompted got %v", lerr.NotPrompted)
+	}
+}
+
+func TestJobActions(t *testing.T) {
+	tests := []struct {
+		method   string
+		hrefSlug string
+		status   int
+		body     string
+		postURL  string
+		monitor  string
+	}{
+		{"relaunch", "/api/v2/jobs/7/", 201, `{"id": 8, "url": "/api/v2/jobs/8/", "status": "pending"}`, "/api/v2/jobs/7/relaunch/", "/api/v2/jobs/8/"},
+		{"cancel", "/api/v2/jobs/7/", 202, "", "/api/v2/jobs/7/cancel/", "/api/v2/jobs/7/"},
+		{"update_inventory_source", "/api/v2/inventory_sources/4/", 202, `{"inventory_update": 12}`, "/api/v2/inventory_sources/4/update/", "/api/v2/inventory_updates/12/"},
+		{"update_project", "/api/v2/projects/3", 202, `{"project_update": 9, "url": "/api/v2/project_updates/9/"}`, "/api/v2/projects/3/update/", "/api/v2/project_updates/9/"},
+	}
+	for _, tt := range tests {
+		jp := JobParam{Method: tt.method, HrefSlug: tt.hrefSlug, RefreshIntervalSeconds: 5, StreamOutput: "events"}
+		ts := &testScaffold{}
+		ts.runSuccess(t, jp, tt.status, []string{tt.body}, []map[string]interface{}{{}})
+		urls := ts.client.Transport.(*fakeTransport).urls
+		if urls[0] != "https://192.1.1.1"+tt.postURL {
+			t.Errorf("%s posted to %v", tt.method, urls)
+		}
+		if len(ts.dispatched) != 1 || ts.dispatched[0].Method != "monitor" || ts.dispatched[0].HrefSlug != tt.monitor {
+			t.Fatalf("%s should monitor %s got %v", tt.method, tt.monitor, ts.dispatched)
+		}
+		if ts.dispatched[0].RefreshIntervalSeconds != 5 || ts.dispatched[0].StreamOutput != "events" {
+			t.Errorf("%s didn't pass the monitor options %+v", tt.method, ts.dispatched[0])
+		}
+	}
+}
+
+func TestCancelFinishedJob(t *testing.T) {
+	jp := JobParam{Method: "cancel", HrefSlug: "/api/v2/jobs/7/"}
+	ts := &testScaffold{}
+	ts.runFail(t, jp, 405, []string{`{"error": "Method not allowed"}`}, "Method not allowed")
+	if len(ts.dispatched) != 0 {
+		t.Fatalf("A job that can't be canceled should not be monitored %v", ts.dispatched)
+	}
+}
+
+func decodeFetchRelated(t *testing.T, s string) []interface{} {
+	var related []interface{}
+	if err := json.Unmarshal([]byte(s), &related); err != nil {
+		t.Fatalf("Error decoding fetch_related %v", err)
+	}
+	return related
+}
+
+func TestFetchRelatedNested(t *testing.T) {
+	responseBody := []string{`{"count": 2, "next": null, "results": [
+		{"id": 1, "related": {"workflow_nodes": "/api/v2/workflow_job_templates/1/workflow_nodes/"}},
+		{"id": 2, "survey_enabled": false, "related": {"workflow_nodes": "/api/v2/workflow_job_templates/2/workflow_nodes/"}}]}`}
+	jp := JobParam{
+		Method:   "get",
+		HrefSlug: "/api/v2/workflow_job_templates/",
+		FetchRelated: decodeFetchRelated(t, `[{"href_slug": "workflow_nodes", "fetch_all_pages": true,
+			"fetch_related": [{"href_slug": "unified_job_template", "fetch_related": [{"href_slug": "survey_spec", "predicate": "survey_enabled"}]}]}]`),
+	}
+	ts := &testScaffold{}
+	ts.runSuccess(t, jp, 200, responseBody, []map[string]interface{}{{"results": []interface{}{}}})
+	if len(ts.dispatched) != 2 {
+		t.Fatalf("Expected 2 related jobs got %v", ts.dispatched)
+	}
+	job := ts.dispatched[0]
+	if job.HrefSlug != "/api/v2/workflow_job_templates/1/workflow_nodes/" || !job.FetchAllPages || job.relatedDepth != 1 {
+		t.Errorf("Unexpected related job %+v", job)
+	}
+
+	// The related job follows the next level of relations
+	responseBody = []string{`{"count": 1, "next": null, "results": [{"id": 5, "unified_job_template": 7, "related": {"unified_job_template": "/api/v2/job_templates/7/"}}]}`}
+	ts = &testScaffold{}
+	ts.runSuccess(t, job, 200, responseBody, []map[string]interface{}{{"results": []interface{}{}}})
+	if len(ts.dispatched) != 1 || ts.dispatched[0].HrefSlug != "/api/v2/job_templates/7/" || ts.dispatched[0].relatedDepth != 2 {
+		t.Fatalf("Expected the unified job template to be fetched got %+v", ts.dispatched)
+	}
+
+	// A single object follows its relations too
+	job = ts.dispatched[0]
+	responseBody = []string{`{"id": 7, "survey_enabled": true, "related": {"survey_spec": "/api/v2/job_templates/7/survey_spec/"}}`}
+	ts = &testScaffold{}
+	ts.runSuccess(t, job, 200, responseBody, []map[string]interface{}{{"id": 7}})
+	if len(ts.dispatched) != 1 || ts.dispatched[0].HrefSlug != "/api/v2/job_templates/7/survey_spec/" || ts.dispatched[0].relatedDepth != 3 {
+		t.Fatalf("Expected the survey spec to be fetched got %+v", ts.dispatched)
+	}
+}
+
+func TestFetchRelatedOnce(t *testing.T) {
+	responseBody := []string{`{"count": 3, "next": null, "results": [
+		{"id": 1, "inventory": 4, "related": {"inventory": "/api/v2/inventories/4/"}},
+		{"id": 2, "inventory": 4, "related": {"inventory": "/api/v2/inventories/4/"}},
+		{"id": 3, "inventory": 5, "related": {"inventory": "/api/v2/inventories/5/"}}]}`}
+	jp := JobParam{Method: "get", HrefSlug: "/api/v2/job_templates/", FetchRelated: decodeFetchRelated(t, `[{"href_slug": "inventory"}]`)}
+	ts := &testScaffold{}
+	ts.base(t, jp, 200, responseBody)
+	ts.wc.task = activeTasks.add(testContext(), "/api/v2/tasks/fetch-related-once")
+	defer activeTasks.remove(ts.wc.task)
+	err := (&DefaultAPIWorker{}).StartWork(testContext(), ts.config, jp, ts.client, ts.wc)
+	ts.stop()
+	if err != nil {
+		t.Fatalf("StartWork failed %v", err)
+	}
+	if len(ts.dispatched) != 2 || ts.dispatched[0].HrefSlug != "/api/v2/inventories/4/" || ts.dispatched[1].HrefSlug != "/api/v2/inventories/5/" {
+		t.Fatalf("Each inventory should be fetched once got %+v", ts.dispatched)
+	}
+}
+
+func TestFetchRelatedOnceWithOptions(t *testing.T) {
+	responseBody := []string{`{"id": 1, "related": {"inventory": "/api/v2/inventories/4/"}}`}
+	jp := JobParam{Method: "get", HrefSlug: "/api/v2/job_templates/1/", FetchRelated: decodeFetchRelated(t, `[
+		{"href_slug": "inventory", "apply_filter": "name"},
+		{"href_slug": "inventory", "apply_filter": "id"},
+		{"href_slug": "inventory", "apply_filter": "name"},
+		{"href_slug": "inventory", "apply_filter": "name", "fetch_related": [{"href_slug": "hosts"}]}]`)}
+	ts := &testScaffold{}
+	ts.base(t, jp, 200, responseBody)
+	ts.wc.task = activeTasks.add(testContext(), "/api/v2/tasks/fetch-related-options")
+	defer activeTasks.remove(ts.wc.task)
+	err := (&DefaultAPIWorker{}).StartWork(testContext(), ts.config, jp, ts.client, ts.wc)
+	ts.stop()
+	if err != nil {
+		t.Fatalf("StartWork failed %v", err)
+	}
+	if len(ts.dispatched) != 3 {
+		t.Fatalf("The inventory should be fetched once for each set of options got %+v", ts.dispatched)
+	}
+	if ts.dispatched[0].ApplyFilter != "name" || ts.dispatched[1].ApplyFilter != "id" || len(ts.dispatched[2].FetchRelated) != 1 {
+		t.Errorf("Unexpected related jobs %+v", ts.dispatched)
+	}
+}
+
+func TestFetchRelatedMaxDepth(t *testing.T) {
+	responseBody := []string{`{"id": 7, "related": {"survey_spec": "/api/v2/job_templates/7/survey_spec/"}}`}
+	jp := JobParam{
+		Method:       "get",
+		HrefSlug:     "/api/v2/job_templates/7/",
+		FetchRelated: decodeFetchRelated(t, `[{"href_slug": "survey_spec"}]`),
+		relatedDepth: maxRelatedDepth,
+	}
+	ts := &testScaffold{}
+	ts.runFail(t, jp, 200, responseBody, "nested more than")
+	if len(ts.dispatched) != 0 {
+		t.Fatalf("No related job should have been dispatched %v", ts.dispatched)
+	}
+}
+
+func TestFetchRelatedPredicate(t *testing.T) {
+	responseBody := []string{`{"count": 3, "next": null, "results": [
+		{"id": 1, "type": "job_template", "survey_enabled": true, "related": {"survey_spec": "/api/v2/job_templates/1/survey_spec/"}},
+		{"id": 2, "type": "job_template", "survey_enabled": false, "related": {"survey_spec": "/api/v2/job_templates/2/survey_spec/"}},
+		{"id": 3, "type": "workflow_job_template", "survey_enabled": true, "related": {"survey_spec": "/api/v2/workflow_job_templates/3/survey_spec/"}}]}`}
+	jp := JobParam{
+		Method:       "get",
+		HrefSlug:     "/api/v2/unified_job_templates/",
+		FetchRelated: decodeFetchRelated(t, `[{"href_slug": "survey_spec", "predicate": "survey_enabled && type=='job_template'"}]`),
+	}
+	ts := &testScaffold{}
+	ts.runSuccess(t, jp, 200, responseBody, []map[string]interface{}{{"results": []interface{}{}}})
+	if len(ts.dispatched) != 1 || ts.dispatched[0].HrefSlug != "/api/v2/job_templates/1/survey_spec/" {
+		t.Fatalf("Only the survey of the first template should be fetched got %+v", ts.dispatched)
+	}
+}
+
+func TestFetchRelatedInvalidPredicate(t *testing.T) {
+	responseBody := []string{`{"count": 1, "next": null, "results": [{"id": 1, "related": {"survey_spec": "/api/v2/job_templates/1/survey_spec/"}}]}`}
+	for _, predicate := range []string{"survey_enabled &&", "length(id)"} {
+		jp := JobParam{
+			Method:       "get",
+			HrefSlug:     "/api/v2/job_templates/",
+			FetchRelated: []interface{}{map[string]interface{}{"href_slug": "survey_spec", "predicate": predicate}},
+		}
+		ts := &testScaffold{}
+		ts.runFail(t, jp, 200, responseBody, "predicate "+predicate)
+	}
+}
+
+func TestStructuredHTTPError(t *testing.T) {
+	jp := JobParam{Method: "get", HrefSlug: "/api/v2/job_templates/5/"}
+	ts := &testScaffold{}
+	ts.runFail(t, jp, 404, []string{`{"detail": "Not found."}`}, "Not found.")
+	e := ts.errors[0]
+	body, _ := e.Body.(map[string]interface{})
+	if e.Category != taskerror.Tower || e.Status != 404 || e.Job != jp.HrefSlug || e.Method != "get" || body["detail"] != "Not found." {
+		t.Fatalf("Unexpected error %+v", e)
+	}
+}
+
+func TestTransportErrorReported(t *testing.T) {
+	dialErr := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	jp := JobParam{Method: "get", HrefSlug: "/api/v2/job_templates/5/"}
+	ts := &testScaffold{}
+	err := ts.runRetry(t, jp, nil, []error{dialErr, dialErr, dialErr}, []string{"", "", ""})
+	if err == nil {
+		t.Fatalf("Get should have failed")
+	}
+	if len(ts.errors) != 1 || ts.errors[0].Category != taskerror.Transport {
+		t.Fatalf("Expected a transport error got %v", ts.errors)
+	}
+}